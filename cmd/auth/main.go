@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -10,57 +9,141 @@ import (
 	service "github.com/co-in/gbsfo-test/pkg/service/v1"
 	_ "github.com/mattn/go-sqlite3"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 )
 
-func readJwtSecret(jwtSecretFile string) ([]byte, error) {
-	f, err := os.OpenFile(jwtSecretFile, os.O_RDWR|os.O_CREATE, 0755)
+// rotateSigningKey asks the running auth service to rotate its signing key.
+func rotateSigningKey(port, alg, token string) error {
+	conn, err := grpc.Dial(port, grpc.WithInsecure())
 	if err != nil {
-		return nil, fmt.Errorf("cant open jwt file: %v", err)
+		return fmt.Errorf("dial auth: %v", err)
 	}
+	defer conn.Close()
 
-	defer func() {
-		_ = f.Close()
-	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	var buff = make([]byte, 32)
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", token)
 
-	info, err := f.Stat()
-	if info.Size() == 0 {
-		_, err = rand.Read(buff)
-		if err != nil {
-			return nil, fmt.Errorf("cant generate jwt vector: %v", err)
-		}
+	resp, err := api.NewAuthClient(conn).RotateSigningKey(ctx, &api.RotateSigningKeyRequest{Alg: alg})
+	if err != nil {
+		return err
+	}
 
-		_, err = f.Write(buff)
-		if err != nil {
-			return nil, fmt.Errorf("cant generate jwt vector: %v", err)
-		}
+	log.Printf("new signing key: %s", resp.Kid)
+
+	return nil
+}
 
-		return buff, nil
+// loadDenylist adds the passwords listed one per line in the file to the
+// built-in ones.
+func loadDenylist(path string) ([]string, error) {
+	denylist := append([]string{}, service.CommonPasswords...)
+	if path == "" {
+		return denylist, nil
 	}
 
-	_, err = f.Read(buff)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("cant read jwt file: %v", err)
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			denylist = append(denylist, line)
+		}
+	}
+
+	return denylist, nil
+}
+
+// parseNetworks parses a comma separated list of CIDR networks.
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
 	}
 
-	return buff, nil
+	return networks, nil
 }
 
 func main() {
 	port := flag.String("port", ":12000", "gRPC port to bind")
+	gRPCPortTodo := flag.String("grpc-port-todo", ":13000", "gRPC port of the todo service")
 	dbFile := flag.String("db-file", "users.db", "SQLite3 file location")
-	jwtSecretFile := flag.String("jwtSecretFile", "secret.dat", "JWT Secret file location")
+	jwtKeyFile := flag.String("jwt-key-file", "signing.pem", "JWT signing keyring file location")
+	jwtAlg := flag.String("jwt-alg", service.AlgEdDSA, "JWT signing algorithm for a new key: EdDSA or RS256")
+	accessTokenTTL := flag.Duration("access-token-ttl", 15*time.Minute, "Access token lifetime")
+	refreshTokenTTL := flag.Duration("refresh-token-ttl", 30*24*time.Hour, "Refresh token lifetime")
+	argon2Memory := flag.Uint("argon2-memory", uint(service.DefaultPasswordHashParams.Memory), "argon2id memory cost in KiB")
+	argon2Iterations := flag.Uint("argon2-iterations", uint(service.DefaultPasswordHashParams.Iterations), "argon2id time cost")
+	argon2Parallelism := flag.Uint("argon2-parallelism", uint(service.DefaultPasswordHashParams.Parallelism), "argon2id parallelism")
+	passwordMinLength := flag.Int("password-min-length", service.DefaultPasswordPolicy.MinLength, "Minimal password length")
+	passwordMinClasses := flag.Int("password-min-classes", service.DefaultPasswordPolicy.MinCharClasses, "Character classes (lower, upper, digit, symbol) a password needs")
+	passwordDenylistFile := flag.String("password-denylist-file", "", "File with additional passwords to reject, one per line")
+	lockoutThreshold := flag.Int("lockout-threshold", service.DefaultLockoutConfig.LoginThreshold, "Failed logins to an account before it is locked")
+	lockoutIPThreshold := flag.Int("lockout-ip-threshold", service.DefaultLockoutConfig.IPThreshold, "Failed logins from an address before it is locked")
+	lockoutBase := flag.Duration("lockout-base", service.DefaultLockoutConfig.BaseLockout, "First lockout, doubled with every further failure")
+	lockoutMax := flag.Duration("lockout-max", service.DefaultLockoutConfig.MaxLockout, "Longest lockout")
+	lockoutWindow := flag.Duration("lockout-window", service.DefaultLockoutConfig.Window, "How long failed logins are remembered")
+	mfaChallengeTTL := flag.Duration("mfa-challenge-ttl", 5*time.Minute, "Time to enter the second factor after the password")
+	totpIssuer := flag.String("totp-issuer", "gbsfo", "Service name shown in authenticator apps")
+	passwordResetTTL := flag.Duration("password-reset-ttl", time.Hour, "Password reset token lifetime")
+	notifyFile := flag.String("notify-file", "", "File the password reset tokens are written to, stdout when empty")
+	trustedProxies := flag.String("trusted-proxies", "127.0.0.1/8,::1/128", "Comma separated networks of the gateways allowed to forward the client address")
+	adminToken := flag.String("admin-token", "", "Access token of an admin for the rotate-key command")
 
 	flag.Parse()
 
-	jwtSecret, err := readJwtSecret(*jwtSecretFile)
+	if flag.Arg(0) == "rotate-key" {
+		err := rotateSigningKey(*port, *jwtAlg, *adminToken)
+		if err != nil {
+			log.Fatalf("failed to rotate signing key: %v", err)
+		}
+
+		return
+	}
+
+	if *argon2Memory > math.MaxUint32 || *argon2Iterations > math.MaxUint32 || *argon2Parallelism > math.MaxUint8 {
+		log.Fatalf("invalid password hash parameters: memory and time cost must fit 32 bits, parallelism 1 to %d", math.MaxUint8)
+	}
+
+	passwordHash := service.PasswordHashParams{
+		Memory:      uint32(*argon2Memory),
+		Iterations:  uint32(*argon2Iterations),
+		Parallelism: uint8(*argon2Parallelism),
+		SaltLength:  service.DefaultPasswordHashParams.SaltLength,
+		KeyLength:   service.DefaultPasswordHashParams.KeyLength,
+	}
+
+	err := passwordHash.Validate()
 	if err != nil {
-		log.Fatalf("failed to open database: %v", err)
+		log.Fatalf("invalid password hash parameters: %v", err)
+	}
+
+	keyring, err := service.LoadKeyring(*jwtKeyFile, *jwtAlg)
+	if err != nil {
+		log.Fatalf("failed to load signing keys: %v", err)
 	}
 
 	db, err := sql.Open("sqlite3", *dbFile)
@@ -71,14 +154,74 @@ func main() {
 		_ = db.Close()
 	}()
 
+	denylist, err := loadDenylist(*passwordDenylistFile)
+	if err != nil {
+		log.Fatalf("failed to load password denylist: %v", err)
+	}
+
+	notifier := service.NewWriterNotifier(os.Stdout)
+	if *notifyFile != "" {
+		notifier, err = service.NewFileNotifier(*notifyFile)
+		if err != nil {
+			log.Fatalf("failed to open notifier: %v", err)
+		}
+	}
+
+	proxies, err := parseNetworks(*trustedProxies)
+	if err != nil {
+		log.Fatalf("invalid -trusted-proxies: %v", err)
+	}
+
+	ctx := context.Background()
+	authServer := service.NewAuthServiceServer(keyring, db, service.AuthConfig{
+		AccessTokenTTL:  *accessTokenTTL,
+		RefreshTokenTTL: *refreshTokenTTL,
+		PasswordHash:    passwordHash,
+		PasswordPolicy: service.PasswordPolicy{
+			MinLength:      *passwordMinLength,
+			MinCharClasses: *passwordMinClasses,
+			Denylist:       denylist,
+		},
+		Lockout: service.LockoutConfig{
+			LoginThreshold: *lockoutThreshold,
+			IPThreshold:    *lockoutIPThreshold,
+			BaseLockout:    *lockoutBase,
+			MaxLockout:     *lockoutMax,
+			Window:         *lockoutWindow,
+		},
+		MfaChallengeTTL:  *mfaChallengeTTL,
+		TotpIssuer:       *totpIssuer,
+		PasswordResetTTL: *passwordResetTTL,
+		Notifier:         notifier,
+		TrustedProxies:   proxies,
+	})
+
+	if flag.Arg(0) == "set-role" {
+		err = service.SetUserRole(ctx, db, flag.Arg(1), flag.Arg(2))
+		if err != nil {
+			log.Fatalf("failed to set role: %v", err)
+		}
+
+		return
+	}
+
 	listen, err := net.Listen("tcp", *port)
 	if err != nil {
 		log.Fatalf("failed tcp listen: %v", err)
 	}
 
-	server := grpc.NewServer()
-	ctx := context.Background()
-	api.RegisterAuthServer(server, service.NewAuthServiceServer(jwtSecret, db))
+	verifier := service.NewAuthServerVerifier(authServer)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(service.AuthUnaryServerInterceptor(verifier)),
+	)
+	api.RegisterAuthServer(server, authServer)
+
+	todoConn, err := grpc.Dial(*gRPCPortTodo, grpc.WithInsecure())
+	if err != nil {
+		log.Fatalf("get Todo client: %v", err)
+	}
+	defer todoConn.Close()
+	api.RegisterAdminAuthServer(server, service.NewAdminAuthServiceServer(db, api.NewTodoClient(todoConn)))
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -2,27 +2,45 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
+
+	service "github.com/co-in/gbsfo-test/pkg/service/v1"
 )
 
 type request struct {
-	name         string
-	method       string
-	url          string
-	authToken    func() string
-	request      func() map[string]interface{}
+	name   string
+	method string
+	url    string
+	// path replaces url when it is only known at run time.
+	path      func() string
+	authToken func() string
+	ifMatch   func() string
+	request   func() map[string]interface{}
+	// form is sent url-encoded instead of request.
+	form         func() url.Values
 	statusCode   int
 	saveResponse func(map[string]interface{})
 }
 
 func (m *request) serializeRequest() io.Reader {
+	if m.form != nil {
+		return strings.NewReader(m.form().Encode())
+	}
+
 	if m.request == nil {
 		return nil
 	}
@@ -35,7 +53,11 @@ func (m *request) serializeRequest() io.Reader {
 
 func (m *request) processRequest() error {
 	data := m.serializeRequest()
-	req, err := http.NewRequest(m.method, "http://"+*HTTPPort+m.url, data)
+	path := m.url
+	if m.path != nil {
+		path = m.path()
+	}
+	req, err := http.NewRequest(m.method, "http://"+*HTTPPort+path, data)
 	if err != nil {
 		return fmt.Errorf("(%s) Create request: %v", m.name, err)
 	}
@@ -44,6 +66,14 @@ func (m *request) processRequest() error {
 		req.Header.Set("Authorization", m.authToken())
 	}
 
+	if m.ifMatch != nil {
+		req.Header.Set("If-Match", m.ifMatch())
+	}
+
+	if m.form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
 	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("(%s) Post: %v", m.name, err)
@@ -70,7 +100,105 @@ func (m *request) processRequest() error {
 	return nil
 }
 
+// bruteForceLogin guesses the password of the "intruded" account.
+func bruteForceLogin(name string, statusCode int) request {
+	return request{
+		name:   name,
+		method: "POST",
+		url:    "/v1/auth/login",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"login": "intruded",
+				"pass":  "guess",
+			}
+		},
+		statusCode: statusCode,
+	}
+}
+
+// checkLockoutBackoff checks the lockout after failed logins, up to far more
+// failures than the scenarios can make while the lockouts run. It doubles
+// with every failure past the threshold and stays at the cap from then on.
+func checkLockoutBackoff() error {
+	cfg := service.DefaultLockoutConfig
+	threshold := cfg.LoginThreshold
+
+	for _, c := range []struct {
+		failures int
+		lockout  time.Duration
+	}{
+		{threshold - 1, 0},
+		{threshold, cfg.BaseLockout},
+		{threshold + 1, 2 * cfg.BaseLockout},
+		{threshold + 4, 16 * cfg.BaseLockout},
+		{threshold + 5, cfg.MaxLockout},
+		{threshold + 29, cfg.MaxLockout},
+		{threshold + 30, cfg.MaxLockout},
+		{threshold + 1000, cfg.MaxLockout},
+	} {
+		if lockout := cfg.Lockout(c.failures, threshold); lockout != c.lockout {
+			return fmt.Errorf("(Lockout Backoff) %d failures: expect %s, got %s", c.failures, c.lockout, lockout)
+		}
+	}
+
+	uncapped := service.LockoutConfig{BaseLockout: cfg.BaseLockout, MaxLockout: math.MaxInt64}
+	if lockout := uncapped.Lockout(threshold+100, threshold); lockout != uncapped.MaxLockout {
+		return fmt.Errorf("(Lockout Backoff) uncapped: expect %s, got %s", uncapped.MaxLockout, lockout)
+	}
+
+	fmt.Println("PASS: (Lockout Backoff)")
+
+	return nil
+}
+
+// totpCode computes the code an authenticator app shows for the secret at t.
+func totpCode(secret string, t time.Time) string {
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(t.Unix()/30))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func mfaLogin(name string) request {
+	return request{
+		name:   name,
+		method: "POST",
+		url:    "/v1/auth/login",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"login": "second-factor",
+				"pass":  "Qwerty-1st",
+			}
+		},
+		statusCode: 200,
+		saveResponse: func(m map[string]interface{}) {
+			mfaToken, _ = m["mfa_token"].(string)
+		},
+	}
+}
+
 var token string
+var guestToken string
+var refreshToken string
+var usedRefreshToken string
+var totpUserToken string
+var totpSecret string
+var mfaToken string
+var recoveryCodes []interface{}
+var apiKey string
+var apiKeyID string
+var laptopToken string
+var phoneToken string
+var laptopSessionID string
+var taskETag string
 var requests = []request{
 	{
 		name:   "User Not Found",
@@ -79,11 +207,23 @@ var requests = []request{
 		request: func() map[string]interface{} {
 			return map[string]interface{}{
 				"login": "admin",
-				"pass":  "qwerty",
+				"pass":  "Qwerty-1st",
 			}
 		},
 		statusCode: 404,
 	},
+	{
+		name:   "User SignUp Invalid Input",
+		method: "POST",
+		url:    "/v1/auth/sign-up",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"login": "a",
+				"pass":  "qwerty",
+			}
+		},
+		statusCode: 400,
+	},
 	{
 		name:   "User SignUp",
 		method: "POST",
@@ -91,7 +231,7 @@ var requests = []request{
 		request: func() map[string]interface{} {
 			return map[string]interface{}{
 				"login": "admin",
-				"pass":  "qwerty",
+				"pass":  "Qwerty-1st",
 			}
 		},
 		statusCode: 200,
@@ -115,12 +255,13 @@ var requests = []request{
 		request: func() map[string]interface{} {
 			return map[string]interface{}{
 				"login": "admin",
-				"pass":  "qwerty",
+				"pass":  "Qwerty-1st",
 			}
 		},
 		statusCode: 200,
 		saveResponse: func(m map[string]interface{}) {
 			token = m["token"].(string)
+			refreshToken = m["refresh_token"].(string)
 		},
 	},
 	{
@@ -130,10 +271,31 @@ var requests = []request{
 		request: func() map[string]interface{} {
 			return map[string]interface{}{
 				"login": "admin",
-				"pass":  "qwerty",
+				"pass":  "Qwerty-1st",
+			}
+		},
+		statusCode: 409,
+	},
+	{
+		name:   "Guest SignUp",
+		method: "POST",
+		url:    "/v1/auth/sign-up",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"login": "guest",
+				"pass":  "Qwerty-1st",
 			}
 		},
-		statusCode: 500,
+		statusCode: 200,
+		saveResponse: func(m map[string]interface{}) {
+			guestToken = m["token"].(string)
+		},
+	},
+	{
+		name:       "Get JWKS",
+		method:     "GET",
+		url:        "/.well-known/jwks.json",
+		statusCode: 200,
 	},
 	{
 		name:   "Check Token Ok",
@@ -155,7 +317,7 @@ var requests = []request{
 				"token": token + "fake",
 			}
 		},
-		statusCode: 500,
+		statusCode: 401,
 	},
 	{
 		name:   "Create Task Without Token",
@@ -167,7 +329,7 @@ var requests = []request{
 				"description": "Fake task",
 			}
 		},
-		statusCode: 403,
+		statusCode: 401,
 	},
 	{
 		name:   "Create Task Invalid Token",
@@ -182,7 +344,7 @@ var requests = []request{
 				"description": "Fake task",
 			}
 		},
-		statusCode: 500,
+		statusCode: 401,
 	},
 	{
 		name:   "Get Not Found Task",
@@ -217,6 +379,33 @@ var requests = []request{
 		},
 		statusCode: 200,
 	},
+	{
+		name:   "Get Task #1 By Another User",
+		method: "GET",
+		url:    "/v1/todo/1",
+		authToken: func() string {
+			return guestToken
+		},
+		statusCode: 404,
+	},
+	{
+		name:   "Delete Task #1 By Another User",
+		method: "DELETE",
+		url:    "/v1/todo/1",
+		authToken: func() string {
+			return guestToken
+		},
+		statusCode: 404,
+	},
+	{
+		name:   "Delete Task #1 By Another User Allow Missing",
+		method: "DELETE",
+		url:    "/v1/todo/1?allow_missing=true",
+		authToken: func() string {
+			return guestToken
+		},
+		statusCode: 200,
+	},
 	{
 		name:   "Update Task #1",
 		method: "PUT",
@@ -232,6 +421,79 @@ var requests = []request{
 		},
 		statusCode: 200,
 	},
+	{
+		name:   "Patch Task #1 Status",
+		method: "PATCH",
+		url:    "/v1/todo/1",
+		authToken: func() string {
+			return token
+		},
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"status": false,
+			}
+		},
+		statusCode: 200,
+		saveResponse: func(m map[string]interface{}) {
+			task, _ := m["task"].(map[string]interface{})
+			taskETag = fmt.Sprintf("%q", fmt.Sprint(task["version"]))
+		},
+	},
+	{
+		name:   "Patch Task #1 Unknown Field",
+		method: "PATCH",
+		url:    "/v1/todo/1?update_mask=title",
+		authToken: func() string {
+			return token
+		},
+		request: func() map[string]interface{} {
+			return map[string]interface{}{}
+		},
+		statusCode: 400,
+	},
+	{
+		name:   "Patch Task #1 Stale ETag",
+		method: "PATCH",
+		url:    "/v1/todo/1",
+		authToken: func() string {
+			return token
+		},
+		ifMatch: func() string {
+			return `"1"`
+		},
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"description": "Stale edit",
+			}
+		},
+		statusCode: 412,
+	},
+	{
+		name:   "Patch Task #1 With ETag",
+		method: "PATCH",
+		url:    "/v1/todo/1",
+		authToken: func() string {
+			return token
+		},
+		ifMatch: func() string {
+			return taskETag
+		},
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"status": true,
+			}
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Delete Task #1 Stale Version",
+		method: "DELETE",
+		url:    "/v1/todo/1?version=1",
+		authToken: func() string {
+			return token
+		},
+		statusCode: 412,
+	},
 	{
 		name:   "Delete Task #1",
 		method: "DELETE",
@@ -250,11 +512,20 @@ var requests = []request{
 		},
 		statusCode: 404,
 	},
+	{
+		name:   "Delete Not Found Task",
+		method: "DELETE",
+		url:    "/v1/todo/1",
+		authToken: func() string {
+			return token
+		},
+		statusCode: 404,
+	},
 	{
 		name:       "Get All Tasks Without Token",
 		method:     "GET",
 		url:        "/v1/todo",
-		statusCode: 403,
+		statusCode: 401,
 	},
 	{
 		name:   "Get All Tasks",
@@ -265,14 +536,643 @@ var requests = []request{
 		},
 		statusCode: 200,
 	},
-}
-
-var HTTPPort = flag.String("port", ":8080", "Gateway port")
-var client *http.Client
-
-func main() {
-	flag.Parse()
-	client = new(http.Client)
+	{
+		name:   "Get All Tasks With Bearer Scheme",
+		method: "GET",
+		url:    "/v1/todo",
+		authToken: func() string {
+			return "Bearer " + token
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Create Tagged Task",
+		method: "POST",
+		url:    "/v1/todo",
+		authToken: func() string {
+			return token
+		},
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"status":      false,
+				"description": "Buy milk",
+				"tags":        []string{"home", "shopping"},
+			}
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Create Task Invalid Tag",
+		method: "POST",
+		url:    "/v1/todo",
+		authToken: func() string {
+			return token
+		},
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"status":      false,
+				"description": "Buy bread",
+				"tags":        []string{"home, shopping"},
+			}
+		},
+		statusCode: 400,
+	},
+	{
+		name:   "Get Tasks By Tag",
+		method: "GET",
+		url:    "/v1/todo?filter=" + url.QueryEscape("tags : \"shopping\" AND status = false"),
+		authToken: func() string {
+			return token
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Get Open Tasks Newest First",
+		method: "GET",
+		url:    "/v1/todo?filter=" + url.QueryEscape("status = false AND description : \"task\"") + "&order_by=" + url.QueryEscape("create_time desc"),
+		authToken: func() string {
+			return token
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Get Tasks Invalid Filter",
+		method: "GET",
+		url:    "/v1/todo?filter=" + url.QueryEscape("title = \"x\"") + "&order_by=" + url.QueryEscape("id sideways"),
+		authToken: func() string {
+			return token
+		},
+		statusCode: 400,
+	},
+	{
+		name:       "Stream All Tasks Without Token",
+		method:     "GET",
+		url:        "/v1/todo/stream",
+		statusCode: 401,
+	},
+	{
+		name:   "Create Task For Stream",
+		method: "POST",
+		url:    "/v1/todo",
+		authToken: func() string {
+			return token
+		},
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"status":      false,
+				"description": "Streamed task",
+			}
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Stream All Tasks",
+		method: "GET",
+		url:    "/v1/todo/stream?limit=10",
+		authToken: func() string {
+			return token
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Refresh Token Ok",
+		method: "POST",
+		url:    "/v1/auth/refresh",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"refresh_token": refreshToken,
+			}
+		},
+		statusCode: 200,
+		saveResponse: func(m map[string]interface{}) {
+			usedRefreshToken = refreshToken
+			token = m["token"].(string)
+			refreshToken = m["refresh_token"].(string)
+		},
+	},
+	{
+		name:   "Refresh Token Reuse",
+		method: "POST",
+		url:    "/v1/auth/refresh",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"refresh_token": usedRefreshToken,
+			}
+		},
+		statusCode: 401,
+	},
+	{
+		name:   "Refresh Token Family Revoked",
+		method: "POST",
+		url:    "/v1/auth/refresh",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"refresh_token": refreshToken,
+			}
+		},
+		statusCode: 401,
+	},
+	{
+		name:   "List Users Without Admin Role",
+		method: "GET",
+		url:    "/v1/admin/users",
+		authToken: func() string {
+			return token
+		},
+		statusCode: 403,
+	},
+	{
+		name:   "Logout",
+		method: "POST",
+		url:    "/v1/auth/logout",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"token": token,
+			}
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Get All Tasks After Logout",
+		method: "GET",
+		url:    "/v1/todo",
+		authToken: func() string {
+			return token
+		},
+		statusCode: 401,
+	},
+	{
+		name:   "Guest Revoke All Sessions",
+		method: "POST",
+		url:    "/v1/auth/revoke-all",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"token": guestToken,
+			}
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Guest Get All Tasks After Revoke",
+		method: "GET",
+		url:    "/v1/todo",
+		authToken: func() string {
+			return guestToken
+		},
+		statusCode: 401,
+	},
+	{
+		name:   "Guest Login Right After Revoke",
+		method: "POST",
+		url:    "/v1/auth/login",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"login": "guest",
+				"pass":  "Qwerty-1st",
+			}
+		},
+		statusCode: 200,
+		saveResponse: func(m map[string]interface{}) {
+			guestToken = m["token"].(string)
+		},
+	},
+	{
+		name:   "Guest Get All Tasks After Login",
+		method: "GET",
+		url:    "/v1/todo",
+		authToken: func() string {
+			return guestToken
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "User Login Before Password Change",
+		method: "POST",
+		url:    "/v1/auth/login",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"login": "admin",
+				"pass":  "Qwerty-1st",
+			}
+		},
+		statusCode: 200,
+		saveResponse: func(m map[string]interface{}) {
+			token = m["token"].(string)
+		},
+	},
+	{
+		name:   "Change Password Too Weak",
+		method: "POST",
+		url:    "/v1/auth/change-password",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"token":        token,
+				"current_pass": "Qwerty-1st",
+				"new_pass":     "password",
+			}
+		},
+		statusCode: 400,
+	},
+	{
+		name:   "Change Password Invalid Current",
+		method: "POST",
+		url:    "/v1/auth/change-password",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"token":        token,
+				"current_pass": "fake",
+				"new_pass":     "Qwerty-2nd",
+			}
+		},
+		statusCode: 403,
+	},
+	{
+		name:   "Change Password",
+		method: "POST",
+		url:    "/v1/auth/change-password",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"token":        token,
+				"current_pass": "Qwerty-1st",
+				"new_pass":     "Qwerty-2nd",
+			}
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Get All Tasks After Password Change",
+		method: "GET",
+		url:    "/v1/todo",
+		authToken: func() string {
+			return token
+		},
+		statusCode: 401,
+	},
+	{
+		name:   "User Login Old Password",
+		method: "POST",
+		url:    "/v1/auth/login",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"login": "admin",
+				"pass":  "Qwerty-1st",
+			}
+		},
+		statusCode: 404,
+	},
+	{
+		name:   "User Login New Password",
+		method: "POST",
+		url:    "/v1/auth/login",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"login": "admin",
+				"pass":  "Qwerty-2nd",
+			}
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Password Reset Request",
+		method: "POST",
+		url:    "/v1/auth/password-reset/request",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"login": "admin",
+			}
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Password Reset Request Unknown User",
+		method: "POST",
+		url:    "/v1/auth/password-reset/request",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"login": "nobody",
+			}
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Password Reset Invalid Token",
+		method: "POST",
+		url:    "/v1/auth/password-reset/confirm",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"reset_token": "fake",
+				"new_pass":    "Qwerty-3rd",
+			}
+		},
+		statusCode: 401,
+	},
+	bruteForceLogin("Brute Force Login #1", 404),
+	bruteForceLogin("Brute Force Login #2", 404),
+	bruteForceLogin("Brute Force Login #3", 404),
+	bruteForceLogin("Brute Force Login #4", 404),
+	bruteForceLogin("Brute Force Login #5", 404),
+	bruteForceLogin("Brute Force Login Locked", 429),
+	{
+		name:   "TOTP User SignUp",
+		method: "POST",
+		url:    "/v1/auth/sign-up",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"login": "second-factor",
+				"pass":  "Qwerty-1st",
+			}
+		},
+		statusCode: 200,
+		saveResponse: func(m map[string]interface{}) {
+			totpUserToken = m["token"].(string)
+		},
+	},
+	{
+		name:   "Enroll TOTP",
+		method: "POST",
+		url:    "/v1/auth/totp/enroll",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"token": totpUserToken,
+			}
+		},
+		statusCode: 200,
+		saveResponse: func(m map[string]interface{}) {
+			totpSecret = m["secret"].(string)
+		},
+	},
+	{
+		name:   "Confirm TOTP Invalid Code",
+		method: "POST",
+		url:    "/v1/auth/totp/confirm",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"token": totpUserToken,
+				"code":  "abcdef",
+			}
+		},
+		statusCode: 400,
+	},
+	{
+		name:   "Confirm TOTP",
+		method: "POST",
+		url:    "/v1/auth/totp/confirm",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"token": totpUserToken,
+				"code":  totpCode(totpSecret, time.Now()),
+			}
+		},
+		statusCode: 200,
+		saveResponse: func(m map[string]interface{}) {
+			recoveryCodes = m["recovery_codes"].([]interface{})
+		},
+	},
+	mfaLogin("TOTP User Login"),
+	{
+		name:   "Login MFA Invalid Code",
+		method: "POST",
+		url:    "/v1/auth/login/mfa",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"mfa_token": mfaToken,
+				"code":      "abcdef",
+			}
+		},
+		statusCode: 401,
+	},
+	{
+		name:   "Login MFA",
+		method: "POST",
+		url:    "/v1/auth/login/mfa",
+		request: func() map[string]interface{} {
+			// The code of the current period was used up by the confirmation.
+			return map[string]interface{}{
+				"mfa_token": mfaToken,
+				"code":      totpCode(totpSecret, time.Now().Add(30*time.Second)),
+			}
+		},
+		statusCode: 200,
+	},
+	mfaLogin("TOTP User Login Again"),
+	{
+		name:   "Login MFA Recovery Code",
+		method: "POST",
+		url:    "/v1/auth/login/mfa",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"mfa_token": mfaToken,
+				"code":      recoveryCodes[0],
+			}
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Create API Key Invalid Scope",
+		method: "POST",
+		url:    "/v1/auth/api-keys",
+		authToken: func() string {
+			return totpUserToken
+		},
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"name":   "ci",
+				"scopes": []string{"users:manage"},
+			}
+		},
+		statusCode: 400,
+	},
+	{
+		name:   "Create Read-Only API Key",
+		method: "POST",
+		url:    "/v1/auth/api-keys",
+		authToken: func() string {
+			return totpUserToken
+		},
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"name":       "ci",
+				"scopes":     []string{"tasks:read"},
+				"expires_at": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			}
+		},
+		statusCode: 200,
+		saveResponse: func(m map[string]interface{}) {
+			apiKey = m["key"].(string)
+			apiKeyID = m["api_key"].(map[string]interface{})["id"].(string)
+		},
+	},
+	{
+		name:   "Get All Tasks With API Key",
+		method: "GET",
+		url:    "/v1/todo",
+		authToken: func() string {
+			return "ApiKey " + apiKey
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Create Task With Read-Only API Key",
+		method: "POST",
+		url:    "/v1/todo",
+		authToken: func() string {
+			return "ApiKey " + apiKey
+		},
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"status":      false,
+				"description": "Read-only task",
+			}
+		},
+		statusCode: 403,
+	},
+	{
+		name:   "List API Keys With API Key",
+		method: "GET",
+		url:    "/v1/auth/api-keys",
+		authToken: func() string {
+			return "ApiKey " + apiKey
+		},
+		statusCode: 401,
+	},
+	{
+		name:   "List API Keys",
+		method: "GET",
+		url:    "/v1/auth/api-keys",
+		authToken: func() string {
+			return totpUserToken
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Revoke API Key",
+		method: "DELETE",
+		path: func() string {
+			return "/v1/auth/api-keys/" + apiKeyID
+		},
+		authToken: func() string {
+			return totpUserToken
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Get All Tasks With Revoked API Key",
+		method: "GET",
+		url:    "/v1/todo",
+		authToken: func() string {
+			return "ApiKey " + apiKey
+		},
+		statusCode: 401,
+	},
+	{
+		name:   "Introspect Without Credentials",
+		method: "POST",
+		url:    "/oauth2/introspect",
+		form: func() url.Values {
+			return url.Values{"token": {totpUserToken}}
+		},
+		statusCode: 401,
+	},
+	{
+		name:   "Introspect Without Permission",
+		method: "POST",
+		url:    "/oauth2/introspect",
+		authToken: func() string {
+			return totpUserToken
+		},
+		form: func() url.Values {
+			return url.Values{"token": {apiKey}, "token_type_hint": {"api_key"}}
+		},
+		statusCode: 403,
+	},
+	{
+		name:   "Laptop SignUp",
+		method: "POST",
+		url:    "/v1/auth/sign-up",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"login": "devices",
+				"pass":  "Qwerty-1st",
+			}
+		},
+		statusCode: 200,
+		saveResponse: func(m map[string]interface{}) {
+			laptopToken = m["token"].(string)
+		},
+	},
+	{
+		name:   "Phone Login",
+		method: "POST",
+		url:    "/v1/auth/login",
+		request: func() map[string]interface{} {
+			return map[string]interface{}{
+				"login": "devices",
+				"pass":  "Qwerty-1st",
+			}
+		},
+		statusCode: 200,
+		saveResponse: func(m map[string]interface{}) {
+			phoneToken = m["token"].(string)
+		},
+	},
+	{
+		name:   "List Sessions",
+		method: "GET",
+		url:    "/v1/auth/sessions",
+		authToken: func() string {
+			return phoneToken
+		},
+		statusCode: 200,
+		saveResponse: func(m map[string]interface{}) {
+			for _, session := range m["sessions"].([]interface{}) {
+				if session := session.(map[string]interface{}); session["current"] == false {
+					laptopSessionID = session["id"].(string)
+				}
+			}
+		},
+	},
+	{
+		name:   "Revoke Laptop Session",
+		method: "DELETE",
+		path: func() string {
+			return "/v1/auth/sessions/" + laptopSessionID
+		},
+		authToken: func() string {
+			return phoneToken
+		},
+		statusCode: 200,
+	},
+	{
+		name:   "Get All Tasks On Laptop",
+		method: "GET",
+		url:    "/v1/todo",
+		authToken: func() string {
+			return laptopToken
+		},
+		statusCode: 401,
+	},
+	{
+		name:   "Get All Tasks On Phone",
+		method: "GET",
+		url:    "/v1/todo",
+		authToken: func() string {
+			return phoneToken
+		},
+		statusCode: 200,
+	},
+}
+
+var HTTPPort = flag.String("port", ":8080", "Gateway port")
+var client *http.Client
+
+func main() {
+	flag.Parse()
+	client = new(http.Client)
+
+	err := checkLockoutBackoff()
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+	}
 
 	for _, r := range requests {
 		err := r.processRequest()
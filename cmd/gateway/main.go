@@ -2,21 +2,117 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
-	"fmt"
 	v1 "github.com/co-in/gbsfo-test/pkg/api/v1"
+	service "github.com/co-in/gbsfo-test/pkg/service/v1"
+	"github.com/golang/protobuf/proto"
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/grpc-ecosystem/grpc-gateway/utilities"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var authClient v1.AuthClient
+var tokenVerifier *service.TokenVerifier
+var trustForwardedFor bool
+
+// Schemes of the Authorization header. API keys are told apart from access
+// tokens by theirs, access tokens may be sent without one.
+const (
+	apiKeyScheme = "ApiKey "
+	bearerScheme = "Bearer "
+)
+
+// clientIP is the address of the HTTP client, taken from X-Forwarded-For
+// only if the gateway runs behind a proxy that sets it.
+func clientIP(r *http.Request) string {
+	if trustForwardedFor {
+		forwarded := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-For"), ",")[0])
+		if forwarded != "" {
+			return forwarded
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// ClientIPAnnotator forwards the address of the HTTP client to the services.
+func ClientIPAnnotator(ctx context.Context, r *http.Request) metadata.MD {
+	return metadata.Pairs(service.MetadataClientIP, clientIP(r))
+}
+
+// HeaderMatcher forwards the headers runtime.DefaultHeaderMatcher does,
+// except the metadata only the gateway may set.
+func HeaderMatcher(key string) (string, bool) {
+	switch strings.TrimPrefix(strings.ToLower(key), "grpc-metadata-") {
+	case service.MetadataClientIP, service.MetadataUserID, service.MetadataUserLogin, service.MetadataUserRoles,
+		service.MetadataSessionID:
+		return "", false
+	}
+
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// authorize verifies the token or API key of the call, checks that its roles allow the
+// method and forwards the identity of its owner to the downstream service.
+func authorize(ctx context.Context, method string) (context.Context, error) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+
+	if len(md["authorization"]) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "empty auth header")
+	}
+
+	tokenString := md["authorization"][0]
+	if tokenString == "" {
+		return nil, status.Error(codes.Unauthenticated, "empty token")
+	}
+
+	callContext := context.Background()
+
+	var resp *v1.CheckJwtTokenResponse
+	var err error
+	apiKey := strings.TrimPrefix(tokenString, apiKeyScheme)
+	if apiKey != tokenString {
+		tokenString, resp, err = tokenVerifier.VerifyApiKey(callContext, apiKey)
+	} else {
+		tokenString = strings.TrimPrefix(tokenString, bearerScheme)
+		resp, err = tokenVerifier.Verify(callContext, tokenString)
+	}
+	if err != nil {
+		return nil, service.AuthenticationError(err)
+	}
+
+	err = service.Authorize(method, resp.Roles, resp.Scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	md = md.Copy()
+	// The services only accept access tokens, so an API key is passed on as
+	// the token it was exchanged for.
+	md.Set("authorization", bearerScheme+tokenString)
+	service.SetIdentityMetadata(md, resp)
+
+	return metadata.NewOutgoingContext(ctx, md), nil
+}
 
 func AccessLogInterceptorStream(
 	ctx context.Context,
@@ -26,7 +122,12 @@ func AccessLogInterceptorStream(
 	streamer grpc.Streamer,
 	opts ...grpc.CallOption,
 ) (grpc.ClientStream, error) {
-	return nil, nil
+	ctx, err := authorize(ctx, method)
+	if err != nil {
+		return nil, err
+	}
+
+	return streamer(ctx, desc, cc, method, opts...)
 }
 
 func AccessLogInterceptorUnary(
@@ -38,38 +139,269 @@ func AccessLogInterceptorUnary(
 	invoker grpc.UnaryInvoker,
 	opts ...grpc.CallOption,
 ) error {
-	md, _ := metadata.FromOutgoingContext(ctx)
+	ctx, err := authorize(ctx, method)
+	if err != nil {
+		return err
+	}
 
-	if len(md["authorization"]) == 0 {
-		return status.Error(codes.PermissionDenied, "empty auth header")
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// RevocationInterceptorUnary keeps the token cache in line with logouts and
+// account changes that pass through the gateway, so they take effect immediately.
+func RevocationInterceptorUnary(
+	ctx context.Context,
+	method string,
+	req interface{},
+	reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	// The token is revoked by the call, so find out whose it is beforehand.
+	var userID, sessionID int64
+	var userToken string
+	switch r := req.(type) {
+	case *v1.LogoutRequest:
+		userToken = r.Token
+	case *v1.RevokeAllSessionsRequest:
+		userToken = r.Token
+	case *v1.ChangePasswordRequest:
+		userToken = r.Token
+	}
+	if userToken != "" {
+		claims, err := tokenVerifier.Verify(ctx, userToken)
+		if err == nil {
+			userID = claims.UserId
+			sessionID = claims.SessionId
+		}
 	}
 
-	tokenString := md["authorization"][0]
-	if tokenString == "" {
-		return status.Error(codes.PermissionDenied, "empty token")
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if err != nil {
+		return err
 	}
 
-	callContext := context.Background()
+	switch r := req.(type) {
+	case *v1.LogoutRequest:
+		tokenVerifier.Revoke(r.Token)
+		if sessionID != 0 {
+			tokenVerifier.RevokeSession(sessionID)
+		}
+	case *v1.RevokeSessionRequest:
+		tokenVerifier.RevokeSession(r.Id)
+	case *v1.RevokeAllSessionsRequest, *v1.ChangePasswordRequest:
+		if userID != 0 {
+			tokenVerifier.RevokeUser(userID)
+		}
+	case *v1.DisableUserRequest:
+		tokenVerifier.RevokeUser(r.Id)
+	case *v1.ForcePasswordResetRequest:
+		tokenVerifier.RevokeUser(r.Id)
+	case *v1.DeleteUserRequest:
+		tokenVerifier.RevokeUser(r.Id)
+	case *v1.RevokeApiKeyRequest:
+		tokenVerifier.RevokeApiKey(r.Id)
+	}
+
+	return nil
+}
+
+// errorBody is the body of every error response of the gateway, whether the
+// error comes from a service, the gateway itself or an unknown route.
+type errorBody struct {
+	Error errorStatus `json:"error"`
+}
+
+type errorStatus struct {
+	Code    int               `json:"code"`
+	Status  string            `json:"status"`
+	Message string            `json:"message"`
+	Details []json.RawMessage `json:"details"`
+}
 
-	resp, err := authClient.CheckJWTToken(callContext, &v1.CheckJwtTokenRequest{Token: tokenString})
+func ErrorHandler(ctx context.Context, mux *runtime.ServeMux, marshaler runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	s := status.Convert(err)
+	if err == runtime.ErrUnknownURI {
+		s = status.New(codes.NotFound, http.StatusText(http.StatusNotFound))
+	}
+
+	body := errorBody{Error: errorStatus{
+		Code:    httpStatusFromStatus(s),
+		Status:  code.Code_name[int32(s.Code())],
+		Message: s.Message(),
+		Details: []json.RawMessage{},
+	}}
+
+	for _, detail := range s.Proto().Details {
+		buf, err := marshaler.Marshal(detail)
+		if err != nil {
+			log.Printf("marshal error detail %s: %v", detail.TypeUrl, err)
+			continue
+		}
+
+		body.Error.Details = append(body.Error.Details, buf)
+	}
+
+	for _, detail := range s.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			w.Header().Set("Retry-After", strconv.FormatInt(info.RetryDelay.GetSeconds(), 10))
+		}
+	}
+
+	w.Header().Del("Trailer")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(body.Error.Code)
+
+	err = json.NewEncoder(w).Encode(body)
 	if err != nil {
-		return fmt.Errorf("JWT token check: %v", err)
+		log.Printf("write error response: %v", err)
 	}
+}
 
-	if !resp.Success {
-		return status.Error(codes.PermissionDenied, "invalid token")
+// httpStatusFromStatus is runtime.HTTPStatusFromCode, except that a task no
+// longer at the version the client sent in If-Match is 412 Precondition Failed.
+func httpStatusFromStatus(s *status.Status) int {
+	for _, detail := range s.Details() {
+		if failure, ok := detail.(*errdetails.PreconditionFailure); ok {
+			for _, violation := range failure.Violations {
+				if violation.Type == service.PreconditionVersion {
+					return http.StatusPreconditionFailed
+				}
+			}
+		}
 	}
 
-	return invoker(callContext, method, req, reply, cc, opts...)
+	return runtime.HTTPStatusFromCode(s.Code())
+}
+
+// ETagResponseOption sets the ETag header of responses carrying a task to its
+// version, so the client can send it back in If-Match.
+func ETagResponseOption(ctx context.Context, w http.ResponseWriter, m proto.Message) error {
+	if resp, ok := m.(interface{ GetTask() *v1.Task }); ok && resp.GetTask() != nil {
+		w.Header().Set("ETag", service.TaskETag(resp.GetTask().Version))
+	}
+
+	return nil
+}
+
+// patternJwks matches /.well-known/jwks.json.
+var patternJwks = runtime.MustPattern(runtime.NewPattern(1,
+	[]int{int(utilities.OpLitPush), 0, int(utilities.OpLitPush), 1},
+	[]string{".well-known", "jwks.json"}, ""))
+
+// JwksHandler serves the public keys in place of the generated route. Each
+// key has only the members of its type, strict JWK parsers reject the empty
+// ones the default marshaler would emit for the others.
+func JwksHandler(mux *runtime.ServeMux) runtime.HandlerFunc {
+	marshaler := &runtime.JSONPb{OrigName: true}
+
+	return func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		ctx, err := runtime.AnnotateContext(ctx, mux, r)
+		if err != nil {
+			runtime.HTTPError(ctx, mux, marshaler, w, r, err)
+			return
+		}
+
+		resp, err := authClient.GetJwks(ctx, &v1.GetJwksRequest{})
+		if err != nil {
+			runtime.HTTPError(ctx, mux, marshaler, w, r, err)
+			return
+		}
+
+		runtime.ForwardResponseMessage(ctx, mux, marshaler, w, r, resp)
+	}
+}
+
+// patternIntrospect matches /oauth2/introspect.
+var patternIntrospect = runtime.MustPattern(runtime.NewPattern(1,
+	[]int{int(utilities.OpLitPush), 0, int(utilities.OpLitPush), 1},
+	[]string{"oauth2", "introspect"}, ""))
+
+// introspectionBody is the response of RFC 7662. Everything but active is
+// left out for tokens that are not active.
+type introspectionBody struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Exp      int64  `json:"exp,omitempty"`
+	Iat      int64  `json:"iat,omitempty"`
+	Sub      string `json:"sub,omitempty"`
+}
+
+// IntrospectHandler serves token introspection. It is not a generated route,
+// as RFC 7662 takes form-encoded requests and wants the dates as JSON numbers.
+// The caller authenticates like for any other call, so tokens cannot be
+// probed anonymously.
+func IntrospectHandler(mux *runtime.ServeMux) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		_, outboundMarshaler := runtime.MarshalerForRequest(mux, r)
+
+		ctx, err := runtime.AnnotateContext(ctx, mux, r)
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outboundMarshaler, w, r, err)
+			return
+		}
+
+		ctx, err = authorize(ctx, "/v1.Auth/introspectToken")
+		if err != nil {
+			runtime.HTTPError(r.Context(), mux, outboundMarshaler, w, r, err)
+			return
+		}
+
+		err = r.ParseForm()
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outboundMarshaler, w, r, status.Error(codes.InvalidArgument, err.Error()))
+			return
+		}
+
+		resp, err := authClient.IntrospectToken(ctx, &v1.IntrospectTokenRequest{
+			Token:         r.PostForm.Get("token"),
+			TokenTypeHint: r.PostForm.Get("token_type_hint"),
+		})
+		if err != nil {
+			runtime.HTTPError(ctx, mux, outboundMarshaler, w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+
+		err = json.NewEncoder(w).Encode(introspectionBody{
+			Active:   resp.Active,
+			Scope:    resp.Scope,
+			ClientID: resp.ClientId,
+			Username: resp.Username,
+			Exp:      resp.Exp,
+			Iat:      resp.Iat,
+			Sub:      resp.Sub,
+		})
+		if err != nil {
+			log.Printf("write introspection response: %v", err)
+		}
+	}
 }
 
 func main() {
 	var gRPCPortAuth = flag.String("grpc-port-auth", ":12000", "gRPC port to bind")
 	var gRPCPortTodo = flag.String("grpc-port-todo", ":13000", "gRPC port to bind")
 	var HTTPPort = flag.String("http-port", ":8080", "gRPC port to bind")
+	var tokenCacheSize = flag.Int("token-cache-size", 10000, "Number of verified tokens to cache")
+	var revocationCheckInterval = flag.Duration("revocation-check-interval", 30*time.Second, "How often cached tokens are re-checked for revocation")
+	var jwksRefreshInterval = flag.Duration("jwks-refresh-interval", 5*time.Minute, "How often the JWKS of the auth service is re-fetched")
+	var forwardedFor = flag.Bool("trust-forwarded-for", false, "Take the client address from X-Forwarded-For")
 
 	flag.Parse()
 
+	trustForwardedFor = *forwardedFor
+
 	ctx := context.Background()
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -80,6 +412,12 @@ func main() {
 			OrigName:     true,
 			EmitDefaults: true,
 		}),
+		// Otherwise GET /v1/todo/{id} shadows GET /v1/todo/stream.
+		runtime.WithLastMatchWins(),
+		runtime.WithProtoErrorHandler(ErrorHandler),
+		runtime.WithMetadata(ClientIPAnnotator),
+		runtime.WithIncomingHeaderMatcher(HeaderMatcher),
+		runtime.WithForwardResponseOption(ETagResponseOption),
 	)
 
 	var err error
@@ -90,23 +428,40 @@ func main() {
 	}
 	defer conn.Close()
 	authClient = v1.NewAuthClient(conn)
+	tokenVerifier = service.NewTokenVerifier(authClient, service.VerifierConfig{
+		CacheSize:               *tokenCacheSize,
+		RevocationCheckInterval: *revocationCheckInterval,
+		KeysRefreshInterval:     *jwksRefreshInterval,
+	})
 
 	err = v1.RegisterAuthHandlerFromEndpoint(ctx, mux, *gRPCPortAuth, []grpc.DialOption{
 		grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(RevocationInterceptorUnary),
 	})
 	if err != nil {
 		log.Fatalf("register Auth handler: %v", err)
 	}
 
+	err = v1.RegisterAdminAuthHandlerFromEndpoint(ctx, mux, *gRPCPortAuth, []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithChainUnaryInterceptor(AccessLogInterceptorUnary, RevocationInterceptorUnary),
+	})
+	if err != nil {
+		log.Fatalf("register AdminAuth handler: %v", err)
+	}
+
 	err = v1.RegisterTodoHandlerFromEndpoint(ctx, mux, *gRPCPortTodo, []grpc.DialOption{
 		grpc.WithInsecure(),
 		grpc.WithUnaryInterceptor(AccessLogInterceptorUnary),
-		//grpc.WithStreamInterceptor(AccessLogInterceptorStream),
+		grpc.WithStreamInterceptor(AccessLogInterceptorStream),
 	})
 	if err != nil {
 		log.Fatalf("register Todo handler: %v", err)
 	}
 
+	mux.Handle(http.MethodGet, patternJwks, JwksHandler(mux))
+	mux.Handle(http.MethodPost, patternIntrospect, IntrospectHandler(mux))
+
 	srv := &http.Server{
 		Addr:    *HTTPPort,
 		Handler: mux,
@@ -12,11 +12,17 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"time"
 )
 
 func main() {
 	port := flag.String("port", ":13000", "gRPC port to bind")
 	dbFile := flag.String("db-file", "todo.db", "SQLite3 file location")
+	gRPCPortAuth := flag.String("grpc-port-auth", ":12000", "gRPC port of the auth service")
+	tokenCacheSize := flag.Int("token-cache-size", 10000, "Number of verified tokens to cache")
+	revocationCheckInterval := flag.Duration("revocation-check-interval", 30*time.Second, "How often cached tokens are re-checked for revocation")
+	jwksRefreshInterval := flag.Duration("jwks-refresh-interval", 5*time.Minute, "How often the JWKS of the auth service is re-fetched")
+	legacyTasksOwner := flag.Int64("legacy-tasks-owner", 0, "User id given the tasks created before tasks had owners")
 
 	flag.Parse()
 
@@ -33,9 +39,26 @@ func main() {
 		log.Fatalf("failed tcp listen: %v", err)
 	}
 
-	server := grpc.NewServer()
+	conn, err := grpc.Dial(*gRPCPortAuth, grpc.WithInsecure())
+	if err != nil {
+		log.Fatalf("get Auth client: %v", err)
+	}
+	defer conn.Close()
+
+	verifier := service.NewTokenVerifier(api.NewAuthClient(conn), service.VerifierConfig{
+		CacheSize:               *tokenCacheSize,
+		RevocationCheckInterval: *revocationCheckInterval,
+		KeysRefreshInterval:     *jwksRefreshInterval,
+	})
+
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(service.AuthUnaryServerInterceptor(verifier)),
+		grpc.StreamInterceptor(service.AuthStreamServerInterceptor(verifier)),
+	)
 	ctx := context.Background()
-	api.RegisterTodoServer(server, service.NewTodoServiceServer(db))
+	api.RegisterTodoServer(server, service.NewTodoServiceServer(db, service.TodoConfig{
+		LegacyTasksOwner: *legacyTasksOwner,
+	}))
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
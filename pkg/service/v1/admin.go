@@ -0,0 +1,260 @@
+package v1
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/co-in/gbsfo-test/pkg/api/v1"
+)
+
+type adminAuthServiceServer struct {
+	db   *sql.DB
+	todo v1.TodoClient
+}
+
+// NewAdminAuthServiceServer manages the accounts stored in db. The tasks of
+// deleted users are removed through todo.
+func NewAdminAuthServiceServer(db *sql.DB, todo v1.TodoClient) v1.AdminAuthServer {
+	return &adminAuthServiceServer{
+		db:   db,
+		todo: todo,
+	}
+}
+
+// selectUser reads the columns scanUser expects, the lockout is joined by loginKey.
+const selectUser = "SELECT u.id, u.login, u.role, u.disabled, u.password_reset_required, a.locked_until " +
+	"FROM `user` u LEFT JOIN `login_attempt` a ON a.key = 'login:' || u.login "
+
+func scanUser(row interface{ Scan(...interface{}) error }, now time.Time) (*v1.User, error) {
+	user := &v1.User{}
+
+	var lockedUntil sql.NullInt64
+
+	err := row.Scan(&user.Id, &user.Login, &user.Role, &user.Disabled, &user.PasswordResetRequired, &lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	if lockedUntil.Int64 > now.Unix() {
+		user.LockedUntil = timestamppb.New(time.Unix(lockedUntil.Int64, 0))
+	}
+
+	return user, nil
+}
+
+func (s *adminAuthServiceServer) getUser(ctx context.Context, id int64) (*v1.User, error) {
+	row := s.db.QueryRowContext(ctx, selectUser+"WHERE u.id = ?", id)
+
+	user, err := scanUser(row, time.Now())
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Errorf(codes.NotFound, "user#%d not found", id)
+		}
+
+		return nil, storageError(err, "failed to select from `user`")
+	}
+
+	return user, nil
+}
+
+// updateUser sets a column of the user and returns the updated record.
+func (s *adminAuthServiceServer) updateUser(ctx context.Context, id int64, column string, value interface{}) (*v1.User, error) {
+	_, err := s.getUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.ExecContext(ctx, "UPDATE `user` SET `"+column+"` = ? WHERE id = ?", value, id)
+	if err != nil {
+		return nil, storageError(err, "failed to update `user`")
+	}
+
+	return s.getUser(ctx, id)
+}
+
+// notSelf keeps admins from locking themselves out.
+func notSelf(ctx context.Context, id int64) error {
+	adminID, err := userIDFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if adminID == id {
+		return status.Error(codes.FailedPrecondition, "cannot be applied to your own account")
+	}
+
+	return nil
+}
+
+func (s *adminAuthServiceServer) ListUsers(ctx context.Context, request *v1.ListUsersRequest) (*v1.ListUsersResponse, error) {
+	var total int
+
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM `user`").Scan(&total)
+	if err != nil {
+		return nil, storageError(err, "failed to count `user`")
+	}
+
+	var limit = int(request.Limit)
+	if limit == 0 {
+		limit = 100
+	}
+
+	rows, err := s.db.QueryContext(ctx, selectUser+"ORDER BY u.id LIMIT ? OFFSET ?", limit, request.Offset)
+	if err != nil {
+		return nil, storageError(err, "failed to select from `user`")
+	}
+	defer rows.Close()
+
+	var users []*v1.User
+
+	now := time.Now()
+
+	for rows.Next() {
+		user, err := scanUser(rows, now)
+		if err != nil {
+			return nil, storageError(err, "failed to select from `user`")
+		}
+
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, storageError(err, "failed to select from `user`")
+	}
+
+	return &v1.ListUsersResponse{
+		Total:  uint32(total),
+		Limit:  request.Limit,
+		Offset: request.Offset,
+		Users:  users,
+	}, nil
+}
+
+// DisableUser blocks logins of the user and invalidates their tokens.
+func (s *adminAuthServiceServer) DisableUser(ctx context.Context, request *v1.DisableUserRequest) (*v1.DisableUserResponse, error) {
+	err := notSelf(ctx, request.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.updateUser(ctx, request.Id, "disabled", true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = revokeUserTokens(ctx, s.db, request.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.DisableUserResponse{User: user}, nil
+}
+
+func (s *adminAuthServiceServer) EnableUser(ctx context.Context, request *v1.EnableUserRequest) (*v1.EnableUserResponse, error) {
+	user, err := s.updateUser(ctx, request.Id, "disabled", false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.EnableUserResponse{User: user}, nil
+}
+
+// ForcePasswordReset invalidates the tokens of the user and blocks their
+// logins and API keys until the password is reset.
+func (s *adminAuthServiceServer) ForcePasswordReset(ctx context.Context, request *v1.ForcePasswordResetRequest) (*v1.ForcePasswordResetResponse, error) {
+	user, err := s.updateUser(ctx, request.Id, "password_reset_required", true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = revokeUserTokens(ctx, s.db, request.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.ForcePasswordResetResponse{User: user}, nil
+}
+
+// UnlockUser lifts the lockout after failed logins to the account. Failures
+// counted for the addresses the logins came from are kept.
+func (s *adminAuthServiceServer) UnlockUser(ctx context.Context, request *v1.UnlockUserRequest) (*v1.UnlockUserResponse, error) {
+	user, err := s.getUser(ctx, request.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = clearFailures(ctx, s.db, loginKey(user.Login))
+	if err != nil {
+		return nil, err
+	}
+
+	user.LockedUntil = nil
+
+	return &v1.UnlockUserResponse{User: user}, nil
+}
+
+// DeleteUser removes the tasks of the user first, so a failure leaves the
+// account in place and the call can be retried.
+func (s *adminAuthServiceServer) DeleteUser(ctx context.Context, request *v1.DeleteUserRequest) (*v1.DeleteUserResponse, error) {
+	err := notSelf(ctx, request.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.getUser(ctx, request.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	// The todo service checks the permission of the admin on its own.
+	md, _ := metadata.FromIncomingContext(ctx)
+	todoCtx := metadata.NewOutgoingContext(ctx, metadata.MD{"authorization": md.Get("authorization")})
+
+	resp, err := s.todo.DeleteUserTasks(todoCtx, &v1.DeleteUserTasksRequest{UserId: request.Id})
+	if err != nil {
+		return nil, status.Error(status.Code(err), "failed to delete tasks: "+status.Convert(err).Message())
+	}
+
+	_, err = s.db.ExecContext(ctx, "DELETE FROM `refresh_token` WHERE user_id = ?", request.Id)
+	if err != nil {
+		return nil, storageError(err, "failed to delete from `refresh_token`")
+	}
+
+	_, err = s.db.ExecContext(ctx, "DELETE FROM `session` WHERE user_id = ?", request.Id)
+	if err != nil {
+		return nil, storageError(err, "failed to delete from `session`")
+	}
+
+	for _, table := range []string{"api_key", "recovery_code", "mfa_challenge", "password_reset_token"} {
+		_, err = s.db.ExecContext(ctx, "DELETE FROM `"+table+"` WHERE user_id = ?", request.Id)
+		if err != nil {
+			return nil, storageError(err, "failed to delete from `"+table+"`")
+		}
+	}
+
+	// Tokens issued to the user stay rejected even if the id were ever
+	// given to a new user.
+	_, err = s.db.ExecContext(ctx, "INSERT OR IGNORE INTO `deleted_user`(`id`, `deleted_at`) VALUES(?, ?)",
+		request.Id, time.Now().Unix())
+	if err != nil {
+		return nil, storageError(err, "failed to insert into `deleted_user`")
+	}
+
+	err = clearFailures(ctx, s.db, loginKey(user.Login))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.ExecContext(ctx, "DELETE FROM `user` WHERE id = ?", request.Id)
+	if err != nil {
+		return nil, storageError(err, "failed to delete from `user`")
+	}
+
+	return &v1.DeleteUserResponse{Success: true, DeletedTasks: resp.Deleted}, nil
+}
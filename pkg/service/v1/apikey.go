@@ -0,0 +1,310 @@
+package v1
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/co-in/gbsfo-test/pkg/api/v1"
+)
+
+const (
+	// apiKeyPrefix marks the keys, so they are easy to spot in leaked configs.
+	apiKeyPrefix = "gbsfo_"
+	// apiKeyShownLength is how much of a key is kept in clear to tell it apart.
+	apiKeyShownLength   = len(apiKeyPrefix) + 6
+	apiKeyNameMaxLength = 64
+)
+
+func createApiKeyTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS api_key (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name VARCHAR(64) NOT NULL,
+		prefix VARCHAR(16) NOT NULL,
+		key_hash CHARACTER(64) UNIQUE NOT NULL,
+		scopes VARCHAR(255) NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER,
+		last_used_at INTEGER,
+		revoked_at INTEGER
+	);
+	CREATE INDEX IF NOT EXISTS api_key_user_id ON api_key (user_id);`)
+	if err != nil {
+		return err
+	}
+
+	return useAutoincrement(ctx, db, "api_key")
+}
+
+// CreateApiKey issues a long-lived key to the caller. The key is returned
+// only here, just its hash is stored.
+func (s *authServiceServer) CreateApiKey(ctx context.Context, req *v1.CreateApiKeyRequest) (*v1.CreateApiKeyResponse, error) {
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	roles := rolesFromContext(ctx)
+
+	var violations fieldViolations
+
+	if name := strings.TrimSpace(req.Name); name == "" || len(name) > apiKeyNameMaxLength {
+		violations.add("name", "must be 1 to %d characters long", apiKeyNameMaxLength)
+	}
+
+	for _, scope := range req.Scopes {
+		if !isApiKeyScope(scope) {
+			violations.add("scopes", "unknown scope %q", scope)
+		} else if !rolesGrant(roles, Permission(scope)) {
+			violations.add("scopes", "scope %q is not granted to you", scope)
+		}
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.AsTime().After(now) {
+		violations.add("expires_at", "must be in the future")
+	}
+
+	err = violations.err()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := randomToken(32)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	key = apiKeyPrefix + key
+
+	var expiresAt sql.NullInt64
+	if req.ExpiresAt != nil {
+		expiresAt = sql.NullInt64{Int64: req.ExpiresAt.AsTime().Unix(), Valid: true}
+	}
+
+	apiKey := &v1.ApiKey{
+		Name:      strings.TrimSpace(req.Name),
+		Prefix:    key[:apiKeyShownLength],
+		Scopes:    req.Scopes,
+		CreatedAt: timestamppb.New(time.Unix(now.Unix(), 0)),
+	}
+
+	if expiresAt.Valid {
+		apiKey.ExpiresAt = timestamppb.New(time.Unix(expiresAt.Int64, 0))
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		"INSERT INTO `api_key`(ROWID, `user_id`, `name`, `prefix`, `key_hash`, `scopes`, `created_at`, `expires_at`) "+
+			"VALUES(null, ?, ?, ?, ?, ?, ?, ?)",
+		userID, apiKey.Name, apiKey.Prefix, hashToken(key), strings.Join(req.Scopes, " "), now.Unix(), expiresAt,
+	)
+	if err != nil {
+		return nil, storageError(err, "failed to insert into `api_key`")
+	}
+
+	apiKey.Id, err = res.LastInsertId()
+	if err != nil {
+		return nil, storageError(err, "failed to retrieve id for created API key")
+	}
+
+	return &v1.CreateApiKeyResponse{ApiKey: apiKey, Key: key}, nil
+}
+
+// ListApiKeys returns the keys of the caller that have not been revoked.
+func (s *authServiceServer) ListApiKeys(ctx context.Context, req *v1.ListApiKeysRequest) (*v1.ListApiKeysResponse, error) {
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, name, prefix, scopes, created_at, expires_at, last_used_at FROM `api_key` "+
+			"WHERE user_id = ? AND revoked_at IS NULL ORDER BY id",
+		userID)
+	if err != nil {
+		return nil, storageError(err, "failed to select from `api_key`")
+	}
+	defer rows.Close()
+
+	list := make([]*v1.ApiKey, 0)
+
+	for rows.Next() {
+		var (
+			apiKey                v1.ApiKey
+			scopes                string
+			createdAt             int64
+			expiresAt, lastUsedAt sql.NullInt64
+		)
+
+		err = rows.Scan(&apiKey.Id, &apiKey.Name, &apiKey.Prefix, &scopes, &createdAt, &expiresAt, &lastUsedAt)
+		if err != nil {
+			return nil, storageError(err, "failed to retrieve field values from `api_key` row")
+		}
+
+		apiKey.Scopes = strings.Fields(scopes)
+		apiKey.CreatedAt = timestamppb.New(time.Unix(createdAt, 0))
+
+		if expiresAt.Valid {
+			apiKey.ExpiresAt = timestamppb.New(time.Unix(expiresAt.Int64, 0))
+		}
+
+		if lastUsedAt.Valid {
+			apiKey.LastUsedAt = timestamppb.New(time.Unix(lastUsedAt.Int64, 0))
+		}
+
+		list = append(list, &apiKey)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, storageError(err, "failed to retrieve data from `api_key`")
+	}
+
+	return &v1.ListApiKeysResponse{ApiKeys: list}, nil
+}
+
+// RevokeApiKey revokes a key of the caller. Tokens already issued for it
+// are rejected by the next revocation check.
+func (s *authServiceServer) RevokeApiKey(ctx context.Context, req *v1.RevokeApiKeyRequest) (*v1.RevokeApiKeyResponse, error) {
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE `api_key` SET `revoked_at` = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		time.Now().Unix(), req.Id, userID)
+	if err != nil {
+		return nil, storageError(err, "failed to update `api_key`")
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, storageError(err, "failed to update `api_key`")
+	}
+
+	if affected == 0 {
+		return nil, status.Errorf(codes.NotFound, "API key#%d not found", req.Id)
+	}
+
+	return &v1.RevokeApiKeyResponse{Success: true}, nil
+}
+
+// ExchangeApiKey issues a short-lived access token limited to the scopes of
+// the key, so the services only ever have to verify access tokens.
+func (s *authServiceServer) ExchangeApiKey(ctx context.Context, req *v1.ExchangeApiKeyRequest) (*v1.ExchangeApiKeyResponse, error) {
+	if req.ApiKey == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty API key")
+	}
+
+	row := s.db.QueryRowContext(ctx,
+		"SELECT k.id, k.user_id, k.scopes, k.expires_at, k.revoked_at, u.login, u.role, u.disabled, u.password_reset_required, u.token_generation "+
+			"FROM `api_key` k JOIN `user` u ON u.id = k.user_id WHERE k.key_hash = ?",
+		hashToken(req.ApiKey))
+
+	var (
+		id, userID, generation  int64
+		scopes, login, role     string
+		expiresAt, revokedAt    sql.NullInt64
+		disabled, resetRequired bool
+	)
+
+	err := row.Scan(&id, &userID, &scopes, &expiresAt, &revokedAt, &login, &role, &disabled, &resetRequired, &generation)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Error(codes.Unauthenticated, "invalid API key")
+		}
+
+		return nil, storageError(err, "failed to select from `api_key`")
+	}
+
+	now := time.Now()
+
+	switch {
+	case revokedAt.Valid:
+		return nil, status.Error(codes.Unauthenticated, "API key revoked")
+	case expiresAt.Valid && now.Unix() >= expiresAt.Int64:
+		return nil, status.Error(codes.Unauthenticated, "API key expired")
+	case disabled:
+		return nil, status.Error(codes.Unauthenticated, "account disabled")
+	case resetRequired:
+		// The key may be what leaked, it works again once the password is reset.
+		return nil, status.Error(codes.FailedPrecondition, "password reset required")
+	}
+
+	_, err = s.db.ExecContext(ctx, "UPDATE `api_key` SET `last_used_at` = ? WHERE id = ?", now.Unix(), id)
+	if err != nil {
+		return nil, storageError(err, "failed to update `api_key`")
+	}
+
+	tokenExpiresAt := now.Add(s.config.AccessTokenTTL)
+	if expiresAt.Valid && expiresAt.Int64 < tokenExpiresAt.Unix() {
+		tokenExpiresAt = time.Unix(expiresAt.Int64, 0)
+	}
+
+	token, err := s.signAccessToken(&Claims{
+		UserID:     userID,
+		Login:      login,
+		Roles:      []string{role},
+		Scope:      apiKeyScope(scopes),
+		ApiKeyID:   id,
+		Generation: generation,
+	}, now, tokenExpiresAt)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &v1.ExchangeApiKeyResponse{
+		Token:     token,
+		ExpiresAt: timestamppb.New(tokenExpiresAt),
+	}, nil
+}
+
+// isApiKeyRevoked reports whether the key of the user was revoked, has expired or is gone.
+func (s *authServiceServer) isApiKeyRevoked(ctx context.Context, userID, id int64, now time.Time) (bool, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT expires_at, revoked_at FROM `api_key` WHERE id = ? AND user_id = ?", id, userID)
+
+	var expiresAt, revokedAt sql.NullInt64
+
+	err := row.Scan(&expiresAt, &revokedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return true, nil
+		}
+
+		return false, storageError(err, "failed to select from `api_key`")
+	}
+
+	return revokedAt.Valid || expiresAt.Valid && now.Unix() >= expiresAt.Int64, nil
+}
+
+// apiKeyScope is the scope of tokens issued for a key with the stored
+// scopes, all of ApiKeyScopes when the key is not limited.
+func apiKeyScope(scopes string) string {
+	if scopes != "" {
+		return scopes
+	}
+
+	all := make([]string, len(ApiKeyScopes))
+	for i, scope := range ApiKeyScopes {
+		all[i] = string(scope)
+	}
+
+	return strings.Join(all, " ")
+}
+
+func isApiKeyScope(scope string) bool {
+	for _, permission := range ApiKeyScopes {
+		if Permission(scope) == permission {
+			return true
+		}
+	}
+
+	return false
+}
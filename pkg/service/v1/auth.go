@@ -2,129 +2,587 @@ package v1
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt"
-
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/co-in/gbsfo-test/pkg/api/v1"
 )
 
+// AuthConfig holds the tunables of the auth service.
+type AuthConfig struct {
+	// AccessTokenTTL is the lifetime of the JWT access tokens.
+	AccessTokenTTL time.Duration
+	// RefreshTokenTTL is the lifetime of a single refresh token.
+	RefreshTokenTTL time.Duration
+	// PasswordHash are the cost parameters for new password hashes,
+	// DefaultPasswordHashParams when left zero.
+	PasswordHash PasswordHashParams
+	// PasswordPolicy is checked for new passwords, DefaultPasswordPolicy
+	// when left zero.
+	PasswordPolicy PasswordPolicy
+	// Lockout throttles failed logins, DefaultLockoutConfig when left zero.
+	Lockout LockoutConfig
+	// MfaChallengeTTL is the time to enter the second factor after the password.
+	MfaChallengeTTL time.Duration
+	// TotpIssuer names the service in authenticator apps.
+	TotpIssuer string
+	// PasswordResetTTL is the lifetime of a password reset token.
+	PasswordResetTTL time.Duration
+	// Notifier delivers password reset tokens, to stdout when left nil.
+	Notifier Notifier
+	// TrustedProxies are the networks of the gateways allowed to forward the
+	// address of their client in MetadataClientIP.
+	TrustedProxies []*net.IPNet
+}
+
 type authServiceServer struct {
-	jwtSecret []byte
-	db        *sql.DB
+	keyring *Keyring
+	db      *sql.DB
+	config  AuthConfig
 }
 
 func (s *authServiceServer) CheckJWTToken(ctx context.Context, request *v1.CheckJwtTokenRequest) (*v1.CheckJwtTokenResponse, error) {
-	if request.Token == "" {
-		return &v1.CheckJwtTokenResponse{Success: false}, status.Error(codes.InvalidArgument, "empty token")
+	claims, err := s.verifyAccessToken(ctx, request.Token)
+	if err != nil {
+		return &v1.CheckJwtTokenResponse{Success: false}, err
 	}
 
-	token, err := jwt.Parse(request.Token, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
+	return checkJwtTokenResponse(claims)
+}
+
+// verifyAccessToken returns the claims of a valid, non-revoked access token.
+func (s *authServiceServer) verifyAccessToken(ctx context.Context, tokenString string) (*Claims, error) {
+	if tokenString == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty token")
+	}
 
-		return s.jwtSecret, nil
-	})
+	claims, err := s.keyring.KeySet().ParseToken(tokenString)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid token: "+err.Error())
+	}
 
+	revoked, err := s.isRevoked(ctx, claims)
 	if err != nil {
-		return &v1.CheckJwtTokenResponse{Success: false}, err
+		return nil, err
+	}
+
+	if revoked {
+		return nil, status.Error(codes.Unauthenticated, "token revoked")
+	}
+
+	if claims.SessionID != 0 {
+		s.touchSession(ctx, claims.SessionID, time.Now())
 	}
 
-	return &v1.CheckJwtTokenResponse{Success: token.Valid}, nil
+	return claims, nil
 }
 
-func NewAuthServiceServer(jwtSecret []byte, db *sql.DB) v1.AuthServer {
+// verifySessionToken is verifyAccessToken for the calls managing the account,
+// which tokens issued for API keys are not allowed to make.
+func (s *authServiceServer) verifySessionToken(ctx context.Context, tokenString string) (*Claims, error) {
+	claims, err := s.verifyAccessToken(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ApiKeyID != 0 {
+		return nil, status.Error(codes.PermissionDenied, "not allowed with an API key")
+	}
+
+	return claims, nil
+}
+
+func checkJwtTokenResponse(claims *Claims) (*v1.CheckJwtTokenResponse, error) {
+	if claims.UserID == 0 {
+		return &v1.CheckJwtTokenResponse{Success: false}, status.Error(codes.InvalidArgument, "token without user id")
+	}
+
+	return &v1.CheckJwtTokenResponse{
+		Success:   true,
+		UserId:    claims.UserID,
+		Login:     claims.Login,
+		IssuedAt:  timestamppb.New(time.Unix(claims.IssuedAt, 0)),
+		ExpiresAt: timestamppb.New(time.Unix(claims.ExpiresAt, 0)),
+		Roles:     claims.Roles,
+		Scopes:    strings.Fields(claims.Scope),
+		ApiKeyId:  claims.ApiKeyID,
+		SessionId: claims.SessionID,
+	}, nil
+}
+
+func NewAuthServiceServer(keyring *Keyring, db *sql.DB, config AuthConfig) v1.AuthServer {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
 	_, err := db.ExecContext(ctx, `
 	CREATE TABLE IF NOT EXISTS user (
-		id INTEGER PRIMARY KEY,
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		login VARCHAR(255) UNIQUE,
-		password_hash CHARACTER(64)
+		password_hash VARCHAR(255)
 	);`)
 
 	if err != nil {
 		log.Print(err)
 	}
 
-	return &authServiceServer{
-		jwtSecret: jwtSecret,
-		db:        db,
+	err = useAutoincrement(ctx, db, "user")
+	if err != nil {
+		log.Print(err)
 	}
-}
 
-func (s *authServiceServer) hash(pass string) string {
-	hash := sha256.Sum256([]byte(pass))
+	err = addColumn(ctx, db, "user", "role", "VARCHAR(32) NOT NULL DEFAULT '"+RoleUser+"'")
+	if err != nil {
+		log.Print(err)
+	}
+
+	err = addColumn(ctx, db, "user", "disabled", "BOOLEAN NOT NULL DEFAULT 0")
+	if err != nil {
+		log.Print(err)
+	}
+
+	err = addColumn(ctx, db, "user", "password_reset_required", "BOOLEAN NOT NULL DEFAULT 0")
+	if err != nil {
+		log.Print(err)
+	}
+
+	err = createRefreshTokenTable(ctx, db)
+	if err != nil {
+		log.Print(err)
+	}
+
+	err = createRevokedTokenTable(ctx, db)
+	if err != nil {
+		log.Print(err)
+	}
+
+	err = createPasswordResetTable(ctx, db)
+	if err != nil {
+		log.Print(err)
+	}
+
+	err = createLoginAttemptTable(ctx, db)
+	if err != nil {
+		log.Print(err)
+	}
+
+	err = createMfaTables(ctx, db)
+	if err != nil {
+		log.Print(err)
+	}
 
-	return fmt.Sprintf("%064X", hash[:])
+	err = createApiKeyTable(ctx, db)
+	if err != nil {
+		log.Print(err)
+	}
+
+	err = createSessionTable(ctx, db)
+	if err != nil {
+		log.Print(err)
+	}
+
+	if config.PasswordHash == (PasswordHashParams{}) {
+		config.PasswordHash = DefaultPasswordHashParams
+	}
+
+	policy := config.PasswordPolicy
+	if policy.MinLength == 0 && policy.MinCharClasses == 0 && policy.Denylist == nil {
+		config.PasswordPolicy = DefaultPasswordPolicy
+	}
+
+	if config.Lockout == (LockoutConfig{}) {
+		config.Lockout = DefaultLockoutConfig
+	}
+
+	if config.MfaChallengeTTL == 0 {
+		config.MfaChallengeTTL = 5 * time.Minute
+	}
+
+	if config.TotpIssuer == "" {
+		config.TotpIssuer = "gbsfo"
+	}
+
+	if config.Notifier == nil {
+		config.Notifier = NewWriterNotifier(os.Stdout)
+	}
+
+	err = keyring.Prune(config.AccessTokenTTL)
+	if err != nil {
+		log.Print(err)
+	}
+
+	return &authServiceServer{
+		keyring: keyring,
+		db:      db,
+		config:  config,
+	}
 }
 
 func (s *authServiceServer) connect(ctx context.Context) (*sql.Conn, error) {
 	c, err := s.db.Conn(ctx)
 	if err != nil {
-		return nil, status.Error(codes.Unknown, "failed to connect to database-> "+err.Error())
+		return nil, storageError(err, "failed to connect to database")
 	}
 
 	return c, nil
 }
 
 func (s *authServiceServer) SignUp(ctx context.Context, req *v1.SignUpRequest) (*v1.SignUpResponse, error) {
+	var violations fieldViolations
+	violations.checkLogin("login", req.Login)
+	violations.checkPassword("pass", req.Pass, s.config.PasswordPolicy)
+
+	err := violations.err()
+	if err != nil {
+		return nil, err
+	}
+
+	passwordHash, err := hashPassword(req.Pass, s.config.PasswordHash)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	res, err := s.db.ExecContext(ctx,
 		"INSERT INTO `user`(ROWID, `login`, `password_hash`) VALUES(null, ?, ?)",
-		req.Login, s.hash(req.Pass),
+		req.Login, passwordHash,
 	)
 	if err != nil {
-		return nil, status.Error(codes.Unknown, "failed to insert into `user` "+err.Error())
+		err = storageError(err, "failed to insert into `user`")
+		if status.Code(err) == codes.AlreadyExists {
+			return nil, status.Errorf(codes.AlreadyExists, "login %s is already taken", req.Login)
+		}
+
+		return nil, err
 	}
 
 	id, err := res.LastInsertId()
 	if err != nil {
-		return nil, status.Error(codes.Unknown, "failed to retrieve id for created ToDo-> "+err.Error())
+		return nil, storageError(err, "failed to retrieve id for created ToDo->")
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":    id,
-		"login": req.Login,
-	})
-
-	tokenString, err := token.SignedString(s.jwtSecret)
+	tokens, err := s.issueTokens(ctx, id, "", 0)
+	if err != nil {
+		return nil, err
+	}
 
 	return &v1.SignUpResponse{
-		Token: tokenString,
+		Token:        tokens.accessToken,
+		RefreshToken: tokens.refreshToken,
+		ExpiresAt:    timestamppb.New(tokens.expiresAt),
 	}, nil
 }
 
 func (s *authServiceServer) Login(ctx context.Context, req *v1.LoginRequest) (*v1.LoginResponse, error) {
-	row := s.db.QueryRowContext(ctx, "SELECT id FROM `user` WHERE login = ? AND password_hash = ?",
-		req.Login, s.hash(req.Pass))
+	ip := s.clientIP(ctx)
+	now := time.Now()
 
-	var id int64
-	err := row.Scan(&id)
+	attempt, err := s.countLoginAttempt(ctx, req.Login, ip, now)
+	if err != nil {
+		return nil, err
+	}
+
+	row := s.db.QueryRowContext(ctx,
+		"SELECT id, password_hash, disabled, password_reset_required, totp_enabled FROM `user` WHERE login = ?",
+		req.Login)
+
+	var (
+		id                                   int64
+		passwordHash                         string
+		disabled, resetRequired, totpEnabled bool
+	)
+
+	err = row.Scan(&id, &passwordHash, &disabled, &resetRequired, &totpEnabled)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			// Spend the same time as for an existing user to not leak which logins are taken.
+			_, _ = hashPassword(req.Pass, s.config.PasswordHash)
+
 			return nil, status.Error(codes.NotFound, "user not found")
 		}
 
-		return nil, status.Error(codes.Unknown, "failed to select into `user` "+err.Error())
+		return nil, storageError(err, "failed to select into `user`")
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":    id,
-		"login": req.Login,
-	})
+	ok, needsRehash, err := verifyPassword(req.Pass, passwordHash, s.config.PasswordHash)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("user#%d: %v", id, err))
+	}
 
-	tokenString, err := token.SignedString(s.jwtSecret)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+
+	err = s.forgive(ctx, attempt)
+	if err != nil {
+		return nil, err
+	}
+
+	if needsRehash {
+		s.rehashPassword(ctx, id, req.Pass)
+	}
+
+	if disabled {
+		return nil, status.Error(codes.PermissionDenied, "account disabled")
+	}
+
+	if resetRequired {
+		return nil, status.Error(codes.FailedPrecondition, "password reset required")
+	}
+
+	// The earlier failures are only cleared once the second factor is verified too.
+	if totpEnabled {
+		mfaToken, err := s.issueMfaChallenge(ctx, id, now)
+		if err != nil {
+			return nil, err
+		}
+
+		return &v1.LoginResponse{MfaRequired: true, MfaToken: mfaToken}, nil
+	}
+
+	err = clearFailures(ctx, s.db, loginKey(req.Login))
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := s.issueTokens(ctx, id, "", 0)
+	if err != nil {
+		return nil, err
+	}
 
 	return &v1.LoginResponse{
-		Token: tokenString,
+		Token:        tokens.accessToken,
+		RefreshToken: tokens.refreshToken,
+		ExpiresAt:    timestamppb.New(tokens.expiresAt),
+	}, nil
+}
+
+// rehashPassword upgrades a stored hash to the current algorithm and
+// parameters. A failure only means the upgrade is retried on next login.
+func (s *authServiceServer) rehashPassword(ctx context.Context, id int64, pass string) {
+	passwordHash, err := hashPassword(pass, s.config.PasswordHash)
+	if err != nil {
+		log.Printf("rehash password of user#%d: %v", id, err)
+		return
+	}
+
+	_, err = s.db.ExecContext(ctx, "UPDATE `user` SET `password_hash` = ? WHERE id = ?", passwordHash, id)
+	if err != nil {
+		log.Printf("rehash password of user#%d: %v", id, err)
+	}
+}
+
+func (s *authServiceServer) Refresh(ctx context.Context, req *v1.RefreshRequest) (*v1.RefreshResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty refresh token")
+	}
+
+	tokens, err := s.rotateRefreshToken(ctx, req.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.RefreshResponse{
+		Token:        tokens.accessToken,
+		RefreshToken: tokens.refreshToken,
+		ExpiresAt:    timestamppb.New(tokens.expiresAt),
+	}, nil
+}
+
+func (s *authServiceServer) Logout(ctx context.Context, req *v1.LogoutRequest) (*v1.LogoutResponse, error) {
+	claims, err := s.verifySessionToken(ctx, req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.revokeAccessToken(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.SessionID != 0 {
+		_, err = revokeSession(ctx, s.db, claims.UserID, claims.SessionID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if req.RefreshToken != "" {
+		err = s.revokeRefreshToken(ctx, claims.UserID, req.RefreshToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &v1.LogoutResponse{Success: true}, nil
+}
+
+func (s *authServiceServer) RevokeAllSessions(ctx context.Context, req *v1.RevokeAllSessionsRequest) (*v1.RevokeAllSessionsResponse, error) {
+	claims, err := s.verifySessionToken(ctx, req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	err = revokeUserTokens(ctx, s.db, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.RevokeAllSessionsResponse{Success: true}, nil
+}
+
+// ChangePassword replaces the password of the token owner, who has to know
+// the current one. All sessions of the user are signed out.
+func (s *authServiceServer) ChangePassword(ctx context.Context, req *v1.ChangePasswordRequest) (*v1.ChangePasswordResponse, error) {
+	claims, err := s.verifySessionToken(ctx, req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	var violations fieldViolations
+	violations.checkPassword("new_pass", req.NewPass, s.config.PasswordPolicy)
+
+	err = violations.err()
+	if err != nil {
+		return nil, err
+	}
+
+	// Guesses count against the same lockout as those at login, or a stolen
+	// session could try every password.
+	attempt, err := s.countLoginAttempt(ctx, claims.Login, s.clientIP(ctx), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	row := s.db.QueryRowContext(ctx, "SELECT password_hash FROM `user` WHERE id = ?", claims.UserID)
+
+	var passwordHash string
+
+	err = row.Scan(&passwordHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+
+		return nil, storageError(err, "failed to select from `user`")
+	}
+
+	ok, _, err := verifyPassword(req.CurrentPass, passwordHash, s.config.PasswordHash)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("user#%d: %v", claims.UserID, err))
+	}
+
+	if !ok {
+		return nil, status.Error(codes.PermissionDenied, "invalid current password")
+	}
+
+	err = s.succeed(ctx, attempt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.setPassword(ctx, claims.UserID, req.NewPass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.ChangePasswordResponse{Success: true}, nil
+}
+
+// RequestPasswordReset sends a reset token to the user. It succeeds for
+// unknown logins too, to not leak which logins are taken.
+func (s *authServiceServer) RequestPasswordReset(ctx context.Context, req *v1.RequestPasswordResetRequest) (*v1.RequestPasswordResetResponse, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT id FROM `user` WHERE login = ?", req.Login)
+
+	var id int64
+
+	err := row.Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return &v1.RequestPasswordResetResponse{Success: true}, nil
+		}
+
+		return nil, storageError(err, "failed to select from `user`")
+	}
+
+	token, expiresAt, err := s.issueResetToken(ctx, id, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.config.Notifier.NotifyPasswordReset(ctx, req.Login, token, expiresAt)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("user#%d: %v", id, err))
+	}
+
+	return &v1.RequestPasswordResetResponse{Success: true}, nil
+}
+
+// ResetPassword sets a new password with a reset token. All sessions of the
+// user are signed out.
+func (s *authServiceServer) ResetPassword(ctx context.Context, req *v1.ResetPasswordRequest) (*v1.ResetPasswordResponse, error) {
+	if req.ResetToken == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty reset token")
+	}
+
+	var violations fieldViolations
+	violations.checkPassword("new_pass", req.NewPass, s.config.PasswordPolicy)
+
+	err := violations.err()
+	if err != nil {
+		return nil, err
+	}
+
+	userID, err := s.consumeResetToken(ctx, req.ResetToken, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.setPassword(ctx, userID, req.NewPass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.ResetPasswordResponse{Success: true}, nil
+}
+
+func (s *authServiceServer) GetJwks(ctx context.Context, req *v1.GetJwksRequest) (*v1.GetJwksResponse, error) {
+	err := s.keyring.Prune(s.config.AccessTokenTTL)
+	if err != nil {
+		log.Print(err)
+	}
+
+	return &v1.GetJwksResponse{
+		Keys: s.keyring.Jwks(),
 	}, nil
 }
+
+func (s *authServiceServer) RotateSigningKey(ctx context.Context, req *v1.RotateSigningKeyRequest) (*v1.RotateSigningKeyResponse, error) {
+	alg := req.Alg
+	if alg == "" {
+		alg = s.keyring.Active().Method.Alg()
+	}
+
+	if alg != AlgEdDSA && alg != AlgRS256 {
+		return nil, status.Error(codes.InvalidArgument, "unsupported signing algorithm "+alg)
+	}
+
+	key, err := s.keyring.Rotate(alg)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	err = s.keyring.Prune(s.config.AccessTokenTTL)
+	if err != nil {
+		log.Print(err)
+	}
+
+	return &v1.RotateSigningKeyResponse{Kid: key.ID}, nil
+}
@@ -0,0 +1,59 @@
+package v1
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/mattn/go-sqlite3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// storageError translates an error of the database into a status with the
+// code the caller should see: a violated UNIQUE or PRIMARY KEY constraint is
+// AlreadyExists, any other constraint FailedPrecondition, a missing row
+// NotFound. What cannot be attributed to the request is Internal. Errors
+// that already carry a status are returned as they are. The error itself is
+// only logged, as it tells about the schema and the queries.
+func storageError(err error, msg string) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	var sqliteErr sqlite3.Error
+
+	code := codes.Internal
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		code = codes.NotFound
+	case errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint:
+		switch sqliteErr.ExtendedCode {
+		case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+			code = codes.AlreadyExists
+		default:
+			code = codes.FailedPrecondition
+		}
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	}
+
+	log.Printf("%s: %v", msg, err)
+
+	return status.Error(code, msg)
+}
+
+// AuthenticationError translates a failed token verification into
+// Unauthenticated, unless the auth service could not be asked at all.
+func AuthenticationError(err error) error {
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.Unavailable, codes.DeadlineExceeded:
+		return err
+	}
+
+	return status.Error(codes.Unauthenticated, "invalid token: "+status.Convert(err).Message())
+}
@@ -0,0 +1,93 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// PreconditionVersion is the type of the PreconditionFailure violation of a
+// task that is no longer at the version the caller expected.
+const PreconditionVersion = "VERSION"
+
+// TaskETag is the entity tag of the task at the version.
+func TaskETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// taskVersions are the versions the task has to be at for the call to change
+// it: the one of the request or, when it has none, those the If-Match header
+// the gateway forwards lists. None means any version will do.
+func taskVersions(ctx context.Context, id, version int64) ([]int64, error) {
+	if version != 0 {
+		return []int64{version}, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	var versions []int64
+
+	for _, header := range md.Get("grpcgateway-if-match") {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" {
+				return nil, nil
+			}
+
+			// Weak tags never match, If-Match compares strongly.
+			unquoted, err := strconv.Unquote(tag)
+			if err != nil || strings.HasPrefix(tag, "W/") {
+				continue
+			}
+
+			v, err := strconv.ParseInt(unquoted, 10, 64)
+			if err != nil {
+				continue
+			}
+
+			versions = append(versions, v)
+		}
+	}
+
+	if len(md.Get("grpcgateway-if-match")) > 0 && len(versions) == 0 {
+		return nil, versionMismatch(id)
+	}
+
+	return versions, nil
+}
+
+// versionCondition restricts the statement to the task at one of the versions.
+func versionCondition(versions []int64) (string, []interface{}) {
+	if len(versions) == 0 {
+		return "", nil
+	}
+
+	args := make([]interface{}, len(versions))
+	for i, v := range versions {
+		args[i] = v
+	}
+
+	return " AND version IN (?" + strings.Repeat(", ?", len(versions)-1) + ")", args
+}
+
+func versionMismatch(id int64) error {
+	st, err := status.New(codes.FailedPrecondition, "task was changed").
+		WithDetails(&errdetails.PreconditionFailure{
+			Violations: []*errdetails.PreconditionFailure_Violation{{
+				Type:        PreconditionVersion,
+				Subject:     fmt.Sprintf("task#%d", id),
+				Description: "task is no longer at the expected version",
+			}},
+		})
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "task#%d was changed", id)
+	}
+
+	return st.Err()
+}
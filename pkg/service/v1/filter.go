@@ -0,0 +1,254 @@
+package v1
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFilterTerms bounds the size of the query a filter compiles to.
+const maxFilterTerms = 16
+
+// taskQuery narrows and orders the tasks a list call returns. Only column
+// names known here make it into the query, values are always parameters.
+type taskQuery struct {
+	// where holds the conditions, each preceded by AND.
+	where   string
+	args    []interface{}
+	orderBy string
+}
+
+// taskTimeColumns are the columns of task times, stored as Unix seconds.
+var taskTimeColumns = map[string]bool{
+	"create_time":   true,
+	"update_time":   true,
+	"complete_time": true,
+}
+
+// taskOrderColumns are the columns tasks can be sorted by.
+var taskOrderColumns = map[string]bool{
+	"id":            true,
+	"status":        true,
+	"description":   true,
+	"create_time":   true,
+	"update_time":   true,
+	"complete_time": true,
+}
+
+var comparisonOperators = map[string]bool{
+	"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+}
+
+// parseTaskQuery compiles the filter and the order of a list call.
+//
+// The filter is a conjunction of comparisons joined by AND, e.g.
+//
+//	status = false AND description : "milk" AND tags : "home" AND create_time >= "2021-10-01T00:00:00Z"
+//
+// status takes = and != with true or false, description = and != or : for
+// "contains", tags : for "has the tag", the times take any comparison with an
+// RFC 3339 time. Tasks without the time never match a comparison of it.
+//
+// The order is a comma separated list of fields, each optionally followed by
+// asc or desc, e.g. "status, update_time desc". Tasks are ordered by id last,
+// so pages of the same query never overlap.
+func parseTaskQuery(filter, orderBy string) (*taskQuery, error) {
+	var (
+		query      taskQuery
+		violations fieldViolations
+	)
+
+	query.where, query.args = compileTaskFilter(filter, &violations)
+	query.orderBy = compileTaskOrder(orderBy, &violations)
+
+	if err := violations.err(); err != nil {
+		return nil, err
+	}
+
+	return &query, nil
+}
+
+func compileTaskFilter(filter string, violations *fieldViolations) (string, []interface{}) {
+	tokens, err := filterTokens(filter)
+	if err != nil {
+		violations.add("filter", "%v", err)
+		return "", nil
+	}
+
+	var (
+		where strings.Builder
+		args  []interface{}
+	)
+
+	for i, terms := 0, 0; i < len(tokens); i += 4 {
+		if terms++; terms > maxFilterTerms {
+			violations.add("filter", "must have at most %d comparisons", maxFilterTerms)
+			return "", nil
+		}
+
+		if len(tokens) < i+3 {
+			violations.add("filter", "incomplete comparison %q", strings.Join(tokens[i:], " "))
+			return "", nil
+		}
+
+		if len(tokens) > i+3 && !strings.EqualFold(tokens[i+3], "AND") {
+			violations.add("filter", "expected AND, got %q", tokens[i+3])
+			return "", nil
+		}
+
+		if len(tokens) == i+4 {
+			violations.add("filter", "expected a comparison after AND")
+			return "", nil
+		}
+
+		field, op, value := tokens[i], tokens[i+1], unquoteFilterValue(tokens[i+2])
+
+		switch {
+		case field == "status":
+			done, err := strconv.ParseBool(value)
+			if err != nil || op != "=" && op != "!=" {
+				violations.add("filter", "status takes = or != with true or false")
+				continue
+			}
+
+			where.WriteString(" AND `status` " + op + " ?")
+			args = append(args, done)
+		case field == "description":
+			switch op {
+			case ":":
+				where.WriteString(" AND `description` LIKE ? ESCAPE '\\'")
+				args = append(args, "%"+escapeLike(value)+"%")
+			case "=", "!=":
+				where.WriteString(" AND `description` " + op + " ?")
+				args = append(args, value)
+			default:
+				violations.add("filter", "description takes =, != or :")
+			}
+		case field == "tags":
+			if op != ":" {
+				violations.add("filter", "tags takes : with a tag")
+				continue
+			}
+
+			where.WriteString(" AND `tags` LIKE ? ESCAPE '\\'")
+			args = append(args, "%,"+escapeLike(value)+",%")
+		case taskTimeColumns[field]:
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil || !comparisonOperators[op] {
+				violations.add("filter", "%s takes a comparison with an RFC 3339 time", field)
+				continue
+			}
+
+			where.WriteString(" AND `" + field + "` " + op + " ?")
+			args = append(args, t.Unix())
+		default:
+			violations.add("filter", "unknown field %q", field)
+		}
+	}
+
+	return where.String(), args
+}
+
+// filterTokens splits the filter into field names, operators, values and the
+// AND keyword. A quoted value is kept with its quotes.
+func filterTokens(filter string) ([]string, error) {
+	var tokens []string
+
+	for i := 0; i < len(filter); {
+		switch c := filter[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(filter) && filter[j] != '"'; j++ {
+				if filter[j] == '\\' {
+					j++
+				}
+			}
+
+			if j >= len(filter) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+
+			tokens = append(tokens, filter[i:j+1])
+			i = j + 1
+		case strings.IndexByte("=!<>:", c) >= 0:
+			j := i + 1
+			if j < len(filter) && filter[j] == '=' {
+				j++
+			}
+
+			op := filter[i:j]
+			if !comparisonOperators[op] && op != ":" {
+				return nil, fmt.Errorf("unknown operator %q", op)
+			}
+
+			tokens = append(tokens, op)
+			i = j
+		default:
+			j := i
+			for j < len(filter) && strings.IndexByte(" \t\"=!<>:", filter[j]) < 0 {
+				j++
+			}
+
+			tokens = append(tokens, filter[i:j])
+			i = j
+		}
+	}
+
+	return tokens, nil
+}
+
+func unquoteFilterValue(value string) string {
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		return unquoted
+	}
+
+	return value
+}
+
+// escapeLike makes the wildcards of LIKE match themselves.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func compileTaskOrder(orderBy string, violations *fieldViolations) string {
+	var columns []string
+
+	seen := make(map[string]bool)
+
+	for _, item := range strings.Split(orderBy, ",") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			if strings.TrimSpace(orderBy) != "" {
+				violations.add("order_by", "empty field")
+			}
+
+			continue
+		}
+
+		field, direction := fields[0], "ASC"
+		if len(fields) == 2 {
+			direction = strings.ToUpper(fields[1])
+		}
+
+		switch {
+		case !taskOrderColumns[field]:
+			violations.add("order_by", "unknown field %q", field)
+		case len(fields) > 2 || direction != "ASC" && direction != "DESC":
+			violations.add("order_by", "%s may only be followed by asc or desc", field)
+		case seen[field]:
+			violations.add("order_by", "%s is given twice", field)
+		default:
+			seen[field] = true
+			columns = append(columns, "`"+field+"` "+direction)
+		}
+	}
+
+	if !seen["id"] {
+		columns = append(columns, "`id` ASC")
+	}
+
+	return strings.Join(columns, ", ")
+}
@@ -0,0 +1,78 @@
+package v1
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/co-in/gbsfo-test/pkg/api/v1"
+)
+
+// gRPC metadata keys carrying the identity of the authenticated user. The
+// gateway forwards them downstream and the auth interceptors overwrite them
+// with the claims of the verified token, so handlers can rely on them.
+const (
+	MetadataUserID    = "x-user-id"
+	MetadataUserLogin = "x-user-login"
+	MetadataUserRoles = "x-user-roles"
+	MetadataSessionID = "x-session-id"
+)
+
+// MetadataClientIP carries the address of the HTTP client the gateway
+// serves, so the auth service can throttle logins per address.
+const MetadataClientIP = "x-client-ip"
+
+// SetIdentityMetadata overwrites the identity keys in md with the verified
+// claims, dropping anything the caller may have sent under the same keys.
+func SetIdentityMetadata(md metadata.MD, claims *v1.CheckJwtTokenResponse) {
+	md.Set(MetadataUserID, strconv.FormatInt(claims.UserId, 10))
+	md.Set(MetadataUserLogin, claims.Login)
+	md.Set(MetadataUserRoles, strings.Join(claims.Roles, ","))
+	md.Set(MetadataSessionID, strconv.FormatInt(claims.SessionId, 10))
+}
+
+func userIDFromContext(ctx context.Context) (int64, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get(MetadataUserID)
+	if len(values) == 0 || values[0] == "" {
+		return 0, status.Error(codes.Unauthenticated, "missing user identity")
+	}
+
+	id, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, status.Error(codes.Unauthenticated, "invalid user identity")
+	}
+
+	return id, nil
+}
+
+// sessionIDFromContext is the session of the caller, zero for tokens issued
+// for API keys.
+func sessionIDFromContext(ctx context.Context) int64 {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get(MetadataSessionID)
+	if len(values) == 0 {
+		return 0
+	}
+
+	id, _ := strconv.ParseInt(values[0], 10, 64)
+
+	return id
+}
+
+func rolesFromContext(ctx context.Context) []string {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get(MetadataUserRoles)
+	if len(values) == 0 || values[0] == "" {
+		return nil
+	}
+
+	return strings.Split(values[0], ",")
+}
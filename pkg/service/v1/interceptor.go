@@ -0,0 +1,110 @@
+package v1
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/co-in/gbsfo-test/pkg/api/v1"
+)
+
+// Verifier returns the verified claims of an access token.
+type Verifier interface {
+	Verify(ctx context.Context, token string) (*v1.CheckJwtTokenResponse, error)
+}
+
+type authServerVerifier struct {
+	server v1.AuthServer
+}
+
+// NewAuthServerVerifier lets the auth service verify tokens sent to itself.
+func NewAuthServerVerifier(server v1.AuthServer) Verifier {
+	return &authServerVerifier{server: server}
+}
+
+func (v *authServerVerifier) Verify(ctx context.Context, token string) (*v1.CheckJwtTokenResponse, error) {
+	resp, err := v.server.CheckJWTToken(ctx, &v1.CheckJwtTokenRequest{Token: token})
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.Success {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	return resp, nil
+}
+
+// authenticatedStream replaces the context of a server stream with one
+// carrying the verified identity.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticate verifies the bearer token of an incoming call, checks it
+// against the policy of the method and replaces any identity metadata sent
+// by the caller with the verified one.
+func authenticate(ctx context.Context, verifier Verifier, method string) (context.Context, error) {
+	if IsPublicMethod(method) {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get("authorization")
+	if len(values) == 0 || values[0] == "" {
+		return nil, status.Error(codes.Unauthenticated, "empty auth header")
+	}
+
+	tokenString := strings.TrimPrefix(values[0], "Bearer ")
+
+	claims, err := verifier.Verify(ctx, tokenString)
+	if err != nil {
+		return nil, AuthenticationError(err)
+	}
+
+	err = Authorize(method, claims.Roles, claims.Scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	md = md.Copy()
+	SetIdentityMetadata(md, claims)
+
+	return metadata.NewIncomingContext(ctx, md), nil
+}
+
+// AuthStreamServerInterceptor requires every non-public stream to carry a
+// valid access token whose roles allow the method.
+func AuthStreamServerInterceptor(verifier Verifier) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(stream.Context(), verifier, info.FullMethod)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// AuthUnaryServerInterceptor requires every non-public unary call to carry a
+// valid access token whose roles allow the method.
+func AuthUnaryServerInterceptor(verifier Verifier) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, verifier, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
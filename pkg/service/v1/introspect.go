@@ -0,0 +1,166 @@
+package v1
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/co-in/gbsfo-test/pkg/api/v1"
+)
+
+// passwordClientID is the client_id of tokens the user got by signing in
+// with the password, as opposed to those issued for an API key.
+const passwordClientID = "password"
+
+// IntrospectToken tells whether a token is active and what it grants, as
+// RFC 7662 describes. Unknown, expired and revoked tokens are all just not
+// active, so the answer does not help guessing tokens.
+func (s *authServiceServer) IntrospectToken(ctx context.Context, req *v1.IntrospectTokenRequest) (*v1.IntrospectTokenResponse, error) {
+	if req.Token == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty token")
+	}
+
+	now := time.Now()
+
+	switch {
+	case strings.HasPrefix(req.Token, apiKeyPrefix):
+		return s.introspectApiKey(ctx, req.Token, now)
+	case strings.Count(req.Token, ".") == 2:
+		return s.introspectAccessToken(ctx, req.Token)
+	default:
+		return s.introspectRefreshToken(ctx, req.Token, now)
+	}
+}
+
+func (s *authServiceServer) introspectAccessToken(ctx context.Context, token string) (*v1.IntrospectTokenResponse, error) {
+	claims, err := s.keyring.KeySet().ParseToken(token)
+	if err != nil {
+		return &v1.IntrospectTokenResponse{Active: false}, nil
+	}
+
+	revoked, err := s.isRevoked(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if revoked {
+		return &v1.IntrospectTokenResponse{Active: false}, nil
+	}
+
+	scope := claims.Scope
+	if scope == "" {
+		scope = roleScope(claims.Roles)
+	}
+
+	return &v1.IntrospectTokenResponse{
+		Active:   true,
+		Scope:    scope,
+		ClientId: clientID(claims.ApiKeyID),
+		Username: claims.Login,
+		Exp:      claims.ExpiresAt,
+		Iat:      claims.IssuedAt,
+		Sub:      strconv.FormatInt(claims.UserID, 10),
+	}, nil
+}
+
+func (s *authServiceServer) introspectRefreshToken(ctx context.Context, token string, now time.Time) (*v1.IntrospectTokenResponse, error) {
+	row := s.db.QueryRowContext(ctx,
+		"SELECT t.user_id, t.issued_at, t.expires_at, t.used_at, t.revoked_at, u.login, u.role, u.disabled "+
+			"FROM `refresh_token` t JOIN `user` u ON u.id = t.user_id WHERE t.token_hash = ?",
+		hashToken(token))
+
+	var (
+		userID, expiresAt           int64
+		issuedAt, usedAt, revokedAt sql.NullInt64
+		login, role                 string
+		disabled                    bool
+	)
+
+	err := row.Scan(&userID, &issuedAt, &expiresAt, &usedAt, &revokedAt, &login, &role, &disabled)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return &v1.IntrospectTokenResponse{Active: false}, nil
+		}
+
+		return nil, storageError(err, "failed to select from `refresh_token`")
+	}
+
+	if usedAt.Valid || revokedAt.Valid || disabled || now.Unix() >= expiresAt {
+		return &v1.IntrospectTokenResponse{Active: false}, nil
+	}
+
+	return &v1.IntrospectTokenResponse{
+		Active:   true,
+		Scope:    roleScope([]string{role}),
+		ClientId: passwordClientID,
+		Username: login,
+		Exp:      expiresAt,
+		Iat:      issuedAt.Int64,
+		Sub:      strconv.FormatInt(userID, 10),
+	}, nil
+}
+
+func (s *authServiceServer) introspectApiKey(ctx context.Context, key string, now time.Time) (*v1.IntrospectTokenResponse, error) {
+	row := s.db.QueryRowContext(ctx,
+		"SELECT k.id, k.user_id, k.scopes, k.created_at, k.expires_at, k.revoked_at, u.login, u.disabled, "+
+			"u.password_reset_required FROM `api_key` k JOIN `user` u ON u.id = k.user_id WHERE k.key_hash = ?",
+		hashToken(key))
+
+	var (
+		id, userID, createdAt   int64
+		scopes, login           string
+		expiresAt, revokedAt    sql.NullInt64
+		disabled, resetRequired bool
+	)
+
+	err := row.Scan(&id, &userID, &scopes, &createdAt, &expiresAt, &revokedAt, &login, &disabled, &resetRequired)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return &v1.IntrospectTokenResponse{Active: false}, nil
+		}
+
+		return nil, storageError(err, "failed to select from `api_key`")
+	}
+
+	// ExchangeApiKey refuses the key while a password reset is pending.
+	if revokedAt.Valid || disabled || resetRequired || expiresAt.Valid && now.Unix() >= expiresAt.Int64 {
+		return &v1.IntrospectTokenResponse{Active: false}, nil
+	}
+
+	return &v1.IntrospectTokenResponse{
+		Active:   true,
+		Scope:    apiKeyScope(scopes),
+		ClientId: clientID(id),
+		Username: login,
+		Exp:      expiresAt.Int64,
+		Iat:      createdAt,
+		Sub:      strconv.FormatInt(userID, 10),
+	}, nil
+}
+
+// roleScope lists the permissions the roles grant.
+func roleScope(roles []string) string {
+	var scope []string
+
+	for _, role := range roles {
+		for _, permission := range rolePermissions[role] {
+			scope = append(scope, string(permission))
+		}
+	}
+
+	return strings.Join(scope, " ")
+}
+
+func clientID(apiKeyID int64) string {
+	if apiKeyID == 0 {
+		return passwordClientID
+	}
+
+	return fmt.Sprintf("api-key#%d", apiKeyID)
+}
@@ -0,0 +1,225 @@
+package v1
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/co-in/gbsfo-test/pkg/api/v1"
+)
+
+// PEM headers recording the lifecycle of a key in the keyring file.
+const (
+	pemHeaderCreated = "Created"
+	pemHeaderRetired = "Retired"
+)
+
+type ringKey struct {
+	*SigningKey
+	createdAt time.Time
+	retiredAt time.Time
+}
+
+// Keyring holds the signing keys of the auth service, persisted as a PEM
+// bundle. The newest key signs new tokens, retired keys are kept for
+// verification only, until every token they signed has expired.
+type Keyring struct {
+	mu   sync.RWMutex
+	path string
+	keys []*ringKey
+}
+
+// LoadKeyring reads the keyring file, creating it with a fresh key of the
+// given algorithm if it does not exist yet.
+func LoadKeyring(path, alg string) (*Keyring, error) {
+	r := &Keyring{path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cant read keyring file: %v", err)
+		}
+
+		_, err = r.Rotate(alg)
+		if err != nil {
+			return nil, err
+		}
+
+		return r, nil
+	}
+
+	for {
+		var block *pem.Block
+
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		key, err := ParseSigningKey(pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes}))
+		if err != nil {
+			return nil, err
+		}
+
+		rk := &ringKey{SigningKey: key}
+
+		// Files written before rotation existed hold a single key without headers.
+		if v, ok := block.Headers[pemHeaderCreated]; ok {
+			rk.createdAt, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", key.ID, err)
+			}
+		}
+
+		if v, ok := block.Headers[pemHeaderRetired]; ok {
+			rk.retiredAt, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", key.ID, err)
+			}
+		}
+
+		r.keys = append(r.keys, rk)
+	}
+
+	if len(r.keys) == 0 || !r.keys[len(r.keys)-1].retiredAt.IsZero() {
+		return nil, fmt.Errorf("keyring %s has no active key", path)
+	}
+
+	return r, nil
+}
+
+// Active returns the key new tokens are signed with.
+func (r *Keyring) Active() *SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.keys[len(r.keys)-1].SigningKey
+}
+
+// Jwks returns the public parts of all keys still accepted for verification.
+func (r *Keyring) Jwks() []*v1.Jwk {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := make([]*v1.Jwk, 0, len(r.keys))
+	for _, key := range r.keys {
+		keys = append(keys, key.Jwk())
+	}
+
+	return keys
+}
+
+// KeySet returns the verification keys of the keyring.
+func (r *Keyring) KeySet() KeySet {
+	return NewKeySet(r.Jwks())
+}
+
+// Rotate generates a new active key and retires the current one. The keys
+// in use only change once the file has them, so a failed write leaves both
+// as they were.
+func (r *Keyring) Rotate(alg string) (*SigningKey, error) {
+	key, err := GenerateSigningKey(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	keys := make([]*ringKey, len(r.keys), len(r.keys)+1)
+	copy(keys, r.keys)
+
+	if len(keys) > 0 {
+		retired := *keys[len(keys)-1]
+		retired.retiredAt = now
+		keys[len(keys)-1] = &retired
+	}
+
+	keys = append(keys, &ringKey{SigningKey: key, createdAt: now})
+
+	err = r.save(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	r.keys = keys
+
+	return key, nil
+}
+
+// Prune drops keys retired longer than maxAge ago, i.e. once no token
+// signed with them can still be valid.
+func (r *Keyring) Prune(maxAge time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	deadline := time.Now().Add(-maxAge)
+	keys := r.keys[:0:0]
+
+	for _, key := range r.keys {
+		if key.retiredAt.IsZero() || key.retiredAt.After(deadline) {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == len(r.keys) {
+		return nil
+	}
+
+	err := r.save(keys)
+	if err != nil {
+		return err
+	}
+
+	r.keys = keys
+
+	return nil
+}
+
+// save writes the keys to the keyring file atomically, so a crash never
+// leaves a partial file.
+func (r *Keyring) save(keys []*ringKey) error {
+	var buff bytes.Buffer
+
+	for _, key := range keys {
+		data, err := key.MarshalPEM()
+		if err != nil {
+			return err
+		}
+
+		block, _ := pem.Decode(data)
+		block.Headers = map[string]string{}
+
+		if !key.createdAt.IsZero() {
+			block.Headers[pemHeaderCreated] = key.createdAt.UTC().Format(time.RFC3339)
+		}
+
+		if !key.retiredAt.IsZero() {
+			block.Headers[pemHeaderRetired] = key.retiredAt.UTC().Format(time.RFC3339)
+		}
+
+		err = pem.Encode(&buff, block)
+		if err != nil {
+			return fmt.Errorf("encode key %s: %v", key.ID, err)
+		}
+	}
+
+	tmp := r.path + ".tmp"
+
+	err := ioutil.WriteFile(tmp, buff.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("cant write keyring file: %v", err)
+	}
+
+	err = os.Rename(tmp, r.path)
+	if err != nil {
+		return fmt.Errorf("cant write keyring file: %v", err)
+	}
+
+	return nil
+}
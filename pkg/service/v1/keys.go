@@ -0,0 +1,254 @@
+package v1
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/co-in/gbsfo-test/pkg/api/v1"
+)
+
+// Supported JWT signing algorithms.
+const (
+	AlgEdDSA = "EdDSA"
+	AlgRS256 = "RS256"
+)
+
+const rsaKeyBits = 2048
+
+// SigningKey is a private key the auth service signs access tokens with.
+type SigningKey struct {
+	// ID is the RFC 7638 thumbprint of the public key, sent as the kid header.
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+}
+
+// GenerateSigningKey creates a new key for the given algorithm.
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	var private crypto.Signer
+
+	switch alg {
+	case AlgEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generate ed25519 key: %v", err)
+		}
+
+		private = key
+	case AlgRS256:
+		key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return nil, fmt.Errorf("generate rsa key: %v", err)
+		}
+
+		private = key
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+
+	return newSigningKey(private)
+}
+
+// ParseSigningKey reads a PKCS #8 private key in PEM form.
+func ParseSigningKey(data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no private key in PEM data")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %v", err)
+	}
+
+	private, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return newSigningKey(private)
+}
+
+func newSigningKey(private crypto.Signer) (*SigningKey, error) {
+	var method jwt.SigningMethod
+
+	switch private.(type) {
+	case ed25519.PrivateKey:
+		method = jwt.SigningMethodEdDSA
+	case *rsa.PrivateKey:
+		method = jwt.SigningMethodRS256
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", private)
+	}
+
+	jwk, err := publicJwk("", method.Alg(), private.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{
+		ID:      jwkThumbprint(jwk),
+		Method:  method,
+		Private: private,
+	}, nil
+}
+
+// MarshalPEM encodes the private key as PKCS #8 PEM.
+func (k *SigningKey) MarshalPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.Private)
+	if err != nil {
+		return nil, fmt.Errorf("marshal private key: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Jwk returns the public part of the key as a JSON Web Key.
+func (k *SigningKey) Jwk() *v1.Jwk {
+	jwk, _ := publicJwk(k.ID, k.Method.Alg(), k.Private.Public())
+
+	return jwk
+}
+
+// Sign returns the signed token with the kid header set.
+func (k *SigningKey) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.Method, claims)
+	token.Header["kid"] = k.ID
+
+	return token.SignedString(k.Private)
+}
+
+func publicJwk(kid, alg string, public crypto.PublicKey) (*v1.Jwk, error) {
+	switch key := public.(type) {
+	case ed25519.PublicKey:
+		return &v1.Jwk{
+			Kty: "OKP",
+			Kid: kid,
+			Use: "sig",
+			Alg: alg,
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key),
+		}, nil
+	case *rsa.PublicKey:
+		return &v1.Jwk{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: alg,
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", public)
+	}
+}
+
+// jwkThumbprint implements RFC 7638: the digest of the required members in
+// lexicographic order without whitespace.
+func jwkThumbprint(jwk *v1.Jwk) string {
+	var members interface{}
+
+	switch jwk.Kty {
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	default:
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	}
+
+	data, _ := json.Marshal(members)
+	hash := sha256.Sum256(data)
+
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// KeySet holds the public keys access tokens are verified against, by kid.
+// It is all a service needs to verify tokens without the signing keys.
+type KeySet map[string]*v1.Jwk
+
+// NewKeySet builds a key set from the keys published at the JWKS endpoint.
+func NewKeySet(keys []*v1.Jwk) KeySet {
+	set := make(KeySet, len(keys))
+
+	for _, key := range keys {
+		set[key.Kid] = key
+	}
+
+	return set
+}
+
+// Keyfunc resolves the verification key of a token for jwt.Parse.
+func (ks KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	jwk, ok := ks[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	if token.Method.Alg() != jwk.Alg {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	switch jwk.Kty {
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || jwk.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid signing key %q", kid)
+		}
+
+		return ed25519.PublicKey(x), nil
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key %q", kid)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key %q", kid)
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %q", jwk.Kty)
+	}
+}
+
+// ParseToken verifies the signature and standard claims of an access token.
+func (ks KeySet) ParseToken(tokenString string) (*Claims, error) {
+	claims := new(Claims)
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, ks.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens minted before expiry was introduced never expire, so refuse them.
+	if !token.Valid || claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	return claims, nil
+}
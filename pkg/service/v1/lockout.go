@@ -0,0 +1,287 @@
+package v1
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// LockoutConfig holds the tunables of the brute-force protection of Login.
+type LockoutConfig struct {
+	// LoginThreshold is the number of failed logins to an account after
+	// which it is locked.
+	LoginThreshold int
+	// IPThreshold is the number of failed logins from an address after
+	// which it is locked. Addresses are often shared, so it is the higher one.
+	IPThreshold int
+	// BaseLockout is the first lockout, every further failure doubles it.
+	BaseLockout time.Duration
+	// MaxLockout caps the lockout.
+	MaxLockout time.Duration
+	// Window is how long a failure is remembered.
+	Window time.Duration
+}
+
+// DefaultLockoutConfig is used when AuthConfig has no lockout set.
+var DefaultLockoutConfig = LockoutConfig{
+	LoginThreshold: 5,
+	IPThreshold:    20,
+	BaseLockout:    30 * time.Second,
+	MaxLockout:     15 * time.Minute,
+	Window:         time.Hour,
+}
+
+// Lockout is how long a key is locked after the failures, none below the
+// threshold. It starts at BaseLockout and doubles with every further failure
+// up to MaxLockout, which it never exceeds however many failures there are.
+func (c LockoutConfig) Lockout(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+
+	lockout := c.BaseLockout
+	for doublings := failures - threshold; doublings > 0 && lockout > 0 && lockout < c.MaxLockout; doublings-- {
+		// Doubling past the cap could overflow into a negative lockout.
+		if lockout > c.MaxLockout/2 {
+			return c.MaxLockout
+		}
+
+		lockout *= 2
+	}
+
+	if lockout > c.MaxLockout {
+		return c.MaxLockout
+	}
+
+	return lockout
+}
+
+func createLoginAttemptTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS login_attempt (
+		key VARCHAR(300) PRIMARY KEY,
+		failures INTEGER NOT NULL,
+		last_failure_at INTEGER NOT NULL,
+		locked_until INTEGER NOT NULL DEFAULT 0
+	);`)
+
+	return err
+}
+
+func loginKey(login string) string {
+	return "login:" + login
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// clientIP is the address the gateway forwarded, or the peer of the call
+// when it was made directly. Only a trusted proxy may forward an address,
+// anyone else could otherwise dodge the lockout of their own one.
+func (s *authServiceServer) clientIP(ctx context.Context) string {
+	var host string
+
+	if p, ok := peer.FromContext(ctx); ok {
+		host, _, _ = net.SplitHostPort(p.Addr.String())
+	}
+
+	if !s.isTrustedProxy(host) {
+		return host
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if values := md.Get(MetadataClientIP); len(values) > 0 && values[0] != "" {
+		return values[0]
+	}
+
+	return host
+}
+
+func (s *authServiceServer) isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range s.config.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loginAttempt is an attempt to prove to be the owner of a login, counted as
+// failed for the login and the address before it is verified, so parallel
+// guesses cannot all get past the lockout.
+type loginAttempt struct {
+	login, ip                 string
+	loginFailures, ipFailures int
+}
+
+// countLoginAttempt counts the attempt for the login and the address, or
+// fails with ResourceExhausted while either is locked.
+func (s *authServiceServer) countLoginAttempt(ctx context.Context, login, ip string, now time.Time) (*loginAttempt, error) {
+	attempt := &loginAttempt{login: login, ip: ip}
+
+	var err error
+
+	attempt.loginFailures, err = s.countFailure(ctx, loginKey(login), s.config.Lockout.LoginThreshold, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip != "" {
+		attempt.ipFailures, err = s.countFailure(ctx, ipKey(ip), s.config.Lockout.IPThreshold, now)
+		if err != nil {
+			uncountErr := s.uncountFailure(ctx, loginKey(login), attempt.loginFailures, s.config.Lockout.LoginThreshold)
+			if uncountErr != nil {
+				return nil, uncountErr
+			}
+
+			return nil, err
+		}
+	}
+
+	return attempt, nil
+}
+
+// forgive takes the attempt back, as it turned out to be right, leaving the
+// failures counted before.
+func (s *authServiceServer) forgive(ctx context.Context, attempt *loginAttempt) error {
+	err := s.uncountFailure(ctx, loginKey(attempt.login), attempt.loginFailures, s.config.Lockout.LoginThreshold)
+	if err != nil {
+		return err
+	}
+
+	if attempt.ip != "" {
+		return s.uncountFailure(ctx, ipKey(attempt.ip), attempt.ipFailures, s.config.Lockout.IPThreshold)
+	}
+
+	return nil
+}
+
+// succeed clears the failures of the login once its owner proved who they
+// are. Failures of the address may be guesses at other logins and are kept.
+func (s *authServiceServer) succeed(ctx context.Context, attempt *loginAttempt) error {
+	err := clearFailures(ctx, s.db, loginKey(attempt.login))
+	if err != nil {
+		return err
+	}
+
+	if attempt.ip != "" {
+		return s.uncountFailure(ctx, ipKey(attempt.ip), attempt.ipFailures, s.config.Lockout.IPThreshold)
+	}
+
+	return nil
+}
+
+// countFailure counts a failure for the key in a single statement and locks
+// it once the threshold is reached, for twice as long with every further
+// failure. It returns the failures counted so far, or fails with
+// ResourceExhausted while the key is locked.
+func (s *authServiceServer) countFailure(ctx context.Context, key string, threshold int, now time.Time) (int, error) {
+	cfg := s.config.Lockout
+
+	_, err := s.db.ExecContext(ctx,
+		"DELETE FROM `login_attempt` WHERE last_failure_at < ? AND locked_until < ?",
+		now.Add(-cfg.Window).Unix(), now.Unix())
+	if err != nil {
+		return 0, storageError(err, "failed to prune `login_attempt`")
+	}
+
+	// A locked key is left as it is. Reaching the threshold locks it for the
+	// longest lockout at first, so no other attempt is counted until the
+	// lockout for this one is set below.
+	longest := now.Add(cfg.MaxLockout).Unix()
+
+	var failures int
+
+	err = s.db.QueryRowContext(ctx,
+		"INSERT INTO `login_attempt`(`key`, `failures`, `last_failure_at`, `locked_until`) "+
+			"VALUES(?, 1, ?, CASE WHEN 1 >= ? THEN ? ELSE 0 END) "+
+			"ON CONFLICT(`key`) DO UPDATE SET `failures` = failures + 1, `last_failure_at` = excluded.last_failure_at, "+
+			"`locked_until` = CASE WHEN failures + 1 >= ? THEN ? ELSE locked_until END WHERE locked_until <= ? "+
+			"RETURNING failures",
+		key, now.Unix(), threshold, longest, threshold, longest, now.Unix(),
+	).Scan(&failures)
+	if err == sql.ErrNoRows {
+		return 0, s.lockoutError(ctx, key, now)
+	}
+
+	if err != nil {
+		return 0, storageError(err, "failed to insert into `login_attempt`")
+	}
+
+	if lockout := cfg.Lockout(failures, threshold); lockout > 0 {
+		_, err = s.db.ExecContext(ctx,
+			"UPDATE `login_attempt` SET `locked_until` = ? WHERE key = ? AND failures = ?",
+			now.Add(lockout).Unix(), key, failures)
+		if err != nil {
+			return 0, storageError(err, "failed to update `login_attempt`")
+		}
+	}
+
+	return failures, nil
+}
+
+// uncountFailure takes back a failure countFailure counted, along with the
+// lock it set. The key was not locked before, or it could not be counted.
+func (s *authServiceServer) uncountFailure(ctx context.Context, key string, failures, threshold int) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE `login_attempt` SET `failures` = MAX(failures - 1, 0), "+
+			"`locked_until` = CASE WHEN ? THEN 0 ELSE locked_until END WHERE key = ?",
+		failures >= threshold, key)
+	if err != nil {
+		return storageError(err, "failed to update `login_attempt`")
+	}
+
+	return nil
+}
+
+// lockoutError is the ResourceExhausted status telling when the key is
+// unlocked again.
+func (s *authServiceServer) lockoutError(ctx context.Context, key string, now time.Time) error {
+	var lockedUntil int64
+
+	err := s.db.QueryRowContext(ctx, "SELECT locked_until FROM `login_attempt` WHERE key = ?", key).Scan(&lockedUntil)
+	if err != nil && err != sql.ErrNoRows {
+		return storageError(err, "failed to select from `login_attempt`")
+	}
+
+	retryDelay := time.Duration(lockedUntil-now.Unix()) * time.Second
+	if retryDelay < time.Second {
+		retryDelay = time.Second
+	}
+
+	st, err := status.New(codes.ResourceExhausted, "too many failed login attempts").
+		WithDetails(&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(retryDelay),
+		})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, fmt.Sprintf("too many failed login attempts, retry in %s", retryDelay))
+	}
+
+	return st.Err()
+}
+
+func clearFailures(ctx context.Context, db *sql.DB, key string) error {
+	_, err := db.ExecContext(ctx, "DELETE FROM `login_attempt` WHERE key = ?", key)
+	if err != nil {
+		return storageError(err, "failed to delete from `login_attempt`")
+	}
+
+	return nil
+}
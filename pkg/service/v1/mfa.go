@@ -0,0 +1,390 @@
+package v1
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/co-in/gbsfo-test/pkg/api/v1"
+)
+
+const (
+	// mfaMaxAttempts is how many codes can be tried with one challenge.
+	mfaMaxAttempts = 5
+	// recoveryCodeCount is how many recovery codes an enrollment yields.
+	recoveryCodeCount = 10
+)
+
+func createMfaTables(ctx context.Context, db *sql.DB) error {
+	columns := [][2]string{
+		{"totp_secret", "VARCHAR(64)"},
+		{"totp_enabled", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"totp_last_counter", "INTEGER NOT NULL DEFAULT 0"},
+	}
+
+	for _, column := range columns {
+		err := addColumn(ctx, db, "user", column[0], column[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS recovery_code (
+		id INTEGER PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		code_hash CHARACTER(64) NOT NULL,
+		used_at INTEGER
+	);
+	CREATE INDEX IF NOT EXISTS recovery_code_user_id ON recovery_code (user_id);
+	CREATE TABLE IF NOT EXISTS mfa_challenge (
+		id INTEGER PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		token_hash CHARACTER(64) UNIQUE NOT NULL,
+		expires_at INTEGER NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0
+	);`)
+
+	return err
+}
+
+// issueMfaChallenge stores a challenge proving the password of the user was
+// verified. It is opaque, so it cannot be mistaken for an access token.
+func (s *authServiceServer) issueMfaChallenge(ctx context.Context, userID int64, now time.Time) (string, error) {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM `mfa_challenge` WHERE expires_at < ?", now.Unix())
+	if err != nil {
+		return "", storageError(err, "failed to prune `mfa_challenge`")
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO `mfa_challenge`(ROWID, `user_id`, `token_hash`, `expires_at`) VALUES(null, ?, ?, ?)",
+		userID, hashToken(token), now.Add(s.config.MfaChallengeTTL).Unix(),
+	)
+	if err != nil {
+		return "", storageError(err, "failed to insert into `mfa_challenge`")
+	}
+
+	return token, nil
+}
+
+// normalizeRecoveryCode accepts the codes however they were copied.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// generateRecoveryCodes replaces the recovery codes of the user. Only the
+// hashes are stored, the codes are shown to the user once.
+func (s *authServiceServer) generateRecoveryCodes(ctx context.Context, userID int64) ([]string, error) {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM `recovery_code` WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, storageError(err, "failed to delete from `recovery_code`")
+	}
+
+	recoveryCodes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		secret, err := generateTotpSecret()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		code := secret[:5] + "-" + secret[5:10]
+
+		_, err = s.db.ExecContext(ctx,
+			"INSERT INTO `recovery_code`(ROWID, `user_id`, `code_hash`) VALUES(null, ?, ?)",
+			userID, hashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, storageError(err, "failed to insert into `recovery_code`")
+		}
+
+		recoveryCodes = append(recoveryCodes, code)
+	}
+
+	return recoveryCodes, nil
+}
+
+// verifySecondFactor accepts a TOTP code not used before or an unused
+// recovery code of the user, and uses it up.
+func (s *authServiceServer) verifySecondFactor(ctx context.Context, userID int64, code string, now time.Time) (bool, error) {
+	row := s.db.QueryRowContext(ctx,
+		"SELECT totp_secret, totp_last_counter FROM `user` WHERE id = ? AND totp_enabled", userID)
+
+	var (
+		secret      sql.NullString
+		lastCounter int64
+	)
+
+	err := row.Scan(&secret, &lastCounter)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+
+		return false, storageError(err, "failed to select from `user`")
+	}
+
+	if counter, ok := verifyTotp(secret.String, code, now, lastCounter); ok {
+		// Guards against the same code being presented concurrently.
+		res, err := s.db.ExecContext(ctx,
+			"UPDATE `user` SET `totp_last_counter` = ? WHERE id = ? AND totp_last_counter < ?",
+			counter, userID, counter)
+		if err != nil {
+			return false, storageError(err, "failed to update `user`")
+		}
+
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return false, storageError(err, "failed to update `user`")
+		}
+
+		return affected == 1, nil
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE `recovery_code` SET `used_at` = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		now.Unix(), userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, storageError(err, "failed to update `recovery_code`")
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, storageError(err, "failed to update `recovery_code`")
+	}
+
+	return affected > 0, nil
+}
+
+// LoginMfa completes a login of an account with two-factor authentication
+// by exchanging the challenge and a code for the tokens.
+func (s *authServiceServer) LoginMfa(ctx context.Context, req *v1.LoginMfaRequest) (*v1.LoginResponse, error) {
+	if req.MfaToken == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty mfa token")
+	}
+
+	now := time.Now()
+
+	row := s.db.QueryRowContext(ctx,
+		"SELECT c.id, c.user_id, c.expires_at, u.login, u.disabled, u.password_reset_required FROM `mfa_challenge` c "+
+			"JOIN `user` u ON u.id = c.user_id WHERE c.token_hash = ?",
+		hashToken(req.MfaToken))
+
+	var (
+		id, userID, expiresAt   int64
+		login                   string
+		disabled, resetRequired bool
+	)
+
+	err := row.Scan(&id, &userID, &expiresAt, &login, &disabled, &resetRequired)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Error(codes.Unauthenticated, "invalid mfa token")
+		}
+
+		return nil, storageError(err, "failed to select from `mfa_challenge`")
+	}
+
+	if now.Unix() >= expiresAt {
+		return nil, status.Error(codes.Unauthenticated, "mfa token expired")
+	}
+
+	attempt, err := s.countLoginAttempt(ctx, login, s.clientIP(ctx), now)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := s.verifySecondFactor(ctx, userID, req.Code, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		_, err = s.db.ExecContext(ctx,
+			"UPDATE `mfa_challenge` SET `attempts` = attempts + 1 WHERE id = ?; "+
+				"DELETE FROM `mfa_challenge` WHERE id = ? AND attempts >= ?",
+			id, id, mfaMaxAttempts)
+		if err != nil {
+			return nil, storageError(err, "failed to update `mfa_challenge`")
+		}
+
+		return nil, status.Error(codes.Unauthenticated, "invalid code")
+	}
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM `mfa_challenge` WHERE id = ?", id)
+	if err != nil {
+		return nil, storageError(err, "failed to delete from `mfa_challenge`")
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, storageError(err, "failed to delete from `mfa_challenge`")
+	}
+
+	// The challenge was exchanged concurrently.
+	if affected == 0 {
+		return nil, status.Error(codes.Unauthenticated, "invalid mfa token")
+	}
+
+	err = s.succeed(ctx, attempt)
+	if err != nil {
+		return nil, err
+	}
+
+	// The account may have been disabled or forced to reset its password
+	// since the password was checked.
+	if disabled {
+		return nil, status.Error(codes.PermissionDenied, "account disabled")
+	}
+
+	if resetRequired {
+		return nil, status.Error(codes.FailedPrecondition, "password reset required")
+	}
+
+	tokens, err := s.issueTokens(ctx, userID, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.LoginResponse{
+		Token:        tokens.accessToken,
+		RefreshToken: tokens.refreshToken,
+		ExpiresAt:    timestamppb.New(tokens.expiresAt),
+	}, nil
+}
+
+// EnrollTotp generates a new TOTP secret for the token owner. Logins do not
+// ask for codes until the enrollment is confirmed with ConfirmTotp.
+func (s *authServiceServer) EnrollTotp(ctx context.Context, req *v1.EnrollTotpRequest) (*v1.EnrollTotpResponse, error) {
+	claims, err := s.verifySessionToken(ctx, req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := generateTotpSecret()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE `user` SET `totp_secret` = ?, `totp_last_counter` = 0 WHERE id = ? AND NOT totp_enabled",
+		secret, claims.UserID)
+	if err != nil {
+		return nil, storageError(err, "failed to update `user`")
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, storageError(err, "failed to update `user`")
+	}
+
+	if affected == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "two-factor authentication already enabled")
+	}
+
+	return &v1.EnrollTotpResponse{
+		Secret:     secret,
+		OtpauthUri: totpURI(s.config.TotpIssuer, claims.Login, secret),
+	}, nil
+}
+
+// ConfirmTotp enables two-factor authentication once the user proves the
+// authenticator works, and hands out the recovery codes.
+func (s *authServiceServer) ConfirmTotp(ctx context.Context, req *v1.ConfirmTotpRequest) (*v1.ConfirmTotpResponse, error) {
+	claims, err := s.verifySessionToken(ctx, req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	row := s.db.QueryRowContext(ctx, "SELECT totp_secret, totp_enabled FROM `user` WHERE id = ?", claims.UserID)
+
+	var (
+		secret  sql.NullString
+		enabled bool
+	)
+
+	err = row.Scan(&secret, &enabled)
+	if err != nil {
+		return nil, storageError(err, "failed to select from `user`")
+	}
+
+	if enabled {
+		return nil, status.Error(codes.FailedPrecondition, "two-factor authentication already enabled")
+	}
+
+	if !secret.Valid {
+		return nil, status.Error(codes.FailedPrecondition, "no two-factor enrollment to confirm")
+	}
+
+	counter, ok := verifyTotp(secret.String, req.Code, time.Now(), 0)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "invalid code")
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		"UPDATE `user` SET `totp_enabled` = 1, `totp_last_counter` = ? WHERE id = ?", counter, claims.UserID)
+	if err != nil {
+		return nil, storageError(err, "failed to update `user`")
+	}
+
+	recoveryCodes, err := s.generateRecoveryCodes(ctx, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.ConfirmTotpResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+// DisableTotp turns two-factor authentication off, given a valid code.
+func (s *authServiceServer) DisableTotp(ctx context.Context, req *v1.DisableTotpRequest) (*v1.DisableTotpResponse, error) {
+	claims, err := s.verifySessionToken(ctx, req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	// Guesses count against the same lockout as those at login, or a stolen
+	// session could try every code.
+	attempt, err := s.countLoginAttempt(ctx, claims.Login, s.clientIP(ctx), now)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := s.verifySecondFactor(ctx, claims.UserID, req.Code, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, status.Error(codes.PermissionDenied, "invalid code")
+	}
+
+	err = s.succeed(ctx, attempt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		"UPDATE `user` SET `totp_enabled` = 0, `totp_secret` = NULL, `totp_last_counter` = 0 WHERE id = ?",
+		claims.UserID)
+	if err != nil {
+		return nil, storageError(err, "failed to update `user`")
+	}
+
+	_, err = s.db.ExecContext(ctx, "DELETE FROM `recovery_code` WHERE user_id = ?", claims.UserID)
+	if err != nil {
+		return nil, storageError(err, "failed to delete from `recovery_code`")
+	}
+
+	return &v1.DisableTotpResponse{Success: true}, nil
+}
@@ -0,0 +1,125 @@
+package v1
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// addColumn adds the column to the table unless it is already there, so
+// databases created by older builds are upgraded in place.
+func addColumn(ctx context.Context, db *sql.DB, table, column, definition string) error {
+	rows, err := db.QueryContext(ctx, "PRAGMA table_info(`"+table+"`)")
+	if err != nil {
+		return fmt.Errorf("table info %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    bool
+			dfltValue  sql.NullString
+			pk         int
+		)
+
+		if err = rows.Scan(&cid, &name, &columnType, &notNull, &dfltValue, &pk); err != nil {
+			return fmt.Errorf("table info %s scan: %v", table, err)
+		}
+
+		if name == column {
+			return nil
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("table info %s: %v", table, err)
+	}
+
+	_, err = db.ExecContext(ctx, "ALTER TABLE `"+table+"` ADD COLUMN `"+column+"` "+definition)
+	if err != nil {
+		return fmt.Errorf("add column %s.%s: %v", table, column, err)
+	}
+
+	return nil
+}
+
+// useAutoincrement rebuilds the table with its id declared AUTOINCREMENT,
+// unless it already is. Otherwise SQLite hands out the ids of deleted rows
+// again, and whatever still refers to a removed row, like a token, comes to
+// refer to the new one.
+func useAutoincrement(ctx context.Context, db *sql.DB, table string) error {
+	const primaryKey = "id INTEGER PRIMARY KEY"
+
+	var schema string
+
+	err := db.QueryRowContext(ctx, "SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&schema)
+	if err != nil {
+		return fmt.Errorf("table schema %s: %v", table, err)
+	}
+
+	if strings.Contains(strings.ToUpper(schema), "AUTOINCREMENT") {
+		return nil
+	}
+
+	if !strings.Contains(schema, primaryKey) {
+		return fmt.Errorf("table %s has no %s", table, primaryKey)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("rebuild %s: %v", table, err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	rows, err := tx.QueryContext(ctx,
+		"SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", table)
+	if err != nil {
+		return fmt.Errorf("indexes of %s: %v", table, err)
+	}
+
+	var indexes []string
+
+	for rows.Next() {
+		var index string
+
+		if err = rows.Scan(&index); err != nil {
+			rows.Close()
+			return fmt.Errorf("indexes of %s scan: %v", table, err)
+		}
+
+		indexes = append(indexes, index)
+	}
+
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("indexes of %s: %v", table, err)
+	}
+
+	statements := []string{
+		"ALTER TABLE `" + table + "` RENAME TO `" + table + "_rebuilt`",
+		strings.Replace(schema, primaryKey, primaryKey+" AUTOINCREMENT", 1),
+		"INSERT INTO `" + table + "` SELECT * FROM `" + table + "_rebuilt`",
+		"DROP TABLE `" + table + "_rebuilt`",
+	}
+
+	for _, statement := range append(statements, indexes...) {
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil {
+			return fmt.Errorf("rebuild %s: %v", table, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("rebuild %s: %v", table, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notifier delivers messages to users out of band, e.g. by e-mail.
+type Notifier interface {
+	// NotifyPasswordReset sends the password reset token to the user.
+	NotifyPasswordReset(ctx context.Context, login, token string, expiresAt time.Time) error
+}
+
+type writerNotifier struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterNotifier writes the notifications to w. Meant for local use,
+// with os.Stdout or a file opened by NewFileNotifier.
+func NewWriterNotifier(w io.Writer) Notifier {
+	return &writerNotifier{w: w}
+}
+
+// NewFileNotifier appends the notifications to the file at path.
+func NewFileNotifier(path string) (Notifier, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open notification file: %v", err)
+	}
+
+	return NewWriterNotifier(f), nil
+}
+
+func (n *writerNotifier) NotifyPasswordReset(ctx context.Context, login, token string, expiresAt time.Time) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	_, err := fmt.Fprintf(n.w, "password reset for %s: token=%s expires_at=%s\n",
+		login, token, expiresAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("write notification: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package v1
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// PasswordHashParams are the argon2id cost parameters used for new hashes.
+type PasswordHashParams struct {
+	// Memory is the amount of memory used by the algorithm in KiB.
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultPasswordHashParams follow the OWASP recommendation for argon2id.
+var DefaultPasswordHashParams = PasswordHashParams{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+var errInvalidPasswordHash = errors.New("invalid password hash")
+
+// Validate reports parameters argon2id cannot hash with.
+func (p PasswordHashParams) Validate() error {
+	switch {
+	case p.Iterations < 1:
+		return errors.New("argon2id time cost must be at least 1")
+	case p.Parallelism < 1:
+		return errors.New("argon2id parallelism must be at least 1")
+	case p.Memory < 8*uint32(p.Parallelism):
+		return fmt.Errorf("argon2id memory must be at least 8 KiB per thread, %d KiB", 8*uint32(p.Parallelism))
+	case p.SaltLength < 1 || p.KeyLength < 1:
+		return errors.New("argon2id salt and key lengths must be at least 1")
+	}
+
+	return nil
+}
+
+// hashPassword returns the hash in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func hashPassword(pass string, params PasswordHashParams) (string, error) {
+	salt := make([]byte, params.SaltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("generate salt: %v", err)
+	}
+
+	key := argon2.IDKey([]byte(pass), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// verifyPassword checks pass against an encoded hash. needsRehash is set
+// when the hash is valid but was produced by an older algorithm or with
+// parameters different from the current ones.
+func verifyPassword(pass, encoded string, params PasswordHashParams) (ok, needsRehash bool, err error) {
+	if !strings.HasPrefix(encoded, "$") {
+		return verifyLegacyPassword(pass, encoded), true, nil
+	}
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, false, errInvalidPasswordHash
+	}
+
+	var version int
+
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, false, errInvalidPasswordHash
+	}
+
+	var current PasswordHashParams
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &current.Memory, &current.Iterations, &current.Parallelism)
+	if err != nil {
+		return false, false, errInvalidPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, errInvalidPasswordHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, errInvalidPasswordHash
+	}
+
+	current.SaltLength = uint32(len(salt))
+	current.KeyLength = uint32(len(key))
+
+	// argon2.IDKey panics on a zero time cost or parallelism.
+	if current.Validate() != nil {
+		return false, false, errInvalidPasswordHash
+	}
+
+	other := argon2.IDKey([]byte(pass), salt, current.Iterations, current.Memory, current.Parallelism, current.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, false, nil
+	}
+
+	return true, current != params, nil
+}
+
+// verifyLegacyPassword checks the unsalted upper-case hex SHA-256 digests
+// stored by earlier versions of the service.
+func verifyLegacyPassword(pass, encoded string) bool {
+	hash := sha256.Sum256([]byte(pass))
+
+	return subtle.ConstantTimeCompare([]byte(strings.ToUpper(hex.EncodeToString(hash[:]))), []byte(encoded)) == 1
+}
@@ -0,0 +1,181 @@
+package v1
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Roles a user can be assigned.
+const (
+	RoleUser     = "user"
+	RoleAdmin    = "admin"
+	RoleReadOnly = "read-only"
+)
+
+// Permission is an action a role may be allowed to perform.
+type Permission string
+
+const (
+	// PermissionPublic marks methods anyone may call, possibly proving who
+	// they are with a token in the request itself.
+	PermissionPublic           Permission = ""
+	PermissionTasksRead        Permission = "tasks:read"
+	PermissionTasksWrite       Permission = "tasks:write"
+	PermissionKeysManage       Permission = "keys:manage"
+	PermissionUsersManage      Permission = "users:manage"
+	PermissionApiKeysManage    Permission = "api-keys:manage"
+	PermissionSessionsManage   Permission = "sessions:manage"
+	PermissionTokensIntrospect Permission = "tokens:introspect"
+)
+
+// ApiKeyScopes are the permissions an API key may be limited to. Managing
+// the account always takes a session of the user.
+var ApiKeyScopes = []Permission{PermissionTasksRead, PermissionTasksWrite, PermissionTokensIntrospect}
+
+var rolePermissions = map[string][]Permission{
+	RoleReadOnly: {PermissionTasksRead, PermissionApiKeysManage, PermissionSessionsManage},
+	RoleUser:     {PermissionTasksRead, PermissionTasksWrite, PermissionApiKeysManage, PermissionSessionsManage},
+	RoleAdmin: {
+		PermissionTasksRead, PermissionTasksWrite, PermissionKeysManage, PermissionUsersManage,
+		PermissionApiKeysManage, PermissionSessionsManage, PermissionTokensIntrospect,
+	},
+}
+
+// methodPermissions maps every gRPC method to the permission it requires.
+// Methods missing here are denied.
+var methodPermissions = caseInsensitive(map[string]Permission{
+	"/v1.Auth/signUp":               PermissionPublic,
+	"/v1.Auth/login":                PermissionPublic,
+	"/v1.Auth/loginMfa":             PermissionPublic,
+	"/v1.Auth/checkJWTToken":        PermissionPublic,
+	"/v1.Auth/refresh":              PermissionPublic,
+	"/v1.Auth/logout":               PermissionPublic,
+	"/v1.Auth/revokeAllSessions":    PermissionPublic,
+	"/v1.Auth/listSessions":         PermissionSessionsManage,
+	"/v1.Auth/revokeSession":        PermissionSessionsManage,
+	"/v1.Auth/changePassword":       PermissionPublic,
+	"/v1.Auth/requestPasswordReset": PermissionPublic,
+	"/v1.Auth/resetPassword":        PermissionPublic,
+	"/v1.Auth/enrollTotp":           PermissionPublic,
+	"/v1.Auth/confirmTotp":          PermissionPublic,
+	"/v1.Auth/disableTotp":          PermissionPublic,
+	"/v1.Auth/getJwks":              PermissionPublic,
+	"/v1.Auth/introspectToken":      PermissionTokensIntrospect,
+	"/v1.Auth/exchangeApiKey":       PermissionPublic,
+	"/v1.Auth/createApiKey":         PermissionApiKeysManage,
+	"/v1.Auth/listApiKeys":          PermissionApiKeysManage,
+	"/v1.Auth/revokeApiKey":         PermissionApiKeysManage,
+	"/v1.Auth/rotateSigningKey":     PermissionKeysManage,
+
+	"/v1.AdminAuth/listUsers":          PermissionUsersManage,
+	"/v1.AdminAuth/disableUser":        PermissionUsersManage,
+	"/v1.AdminAuth/enableUser":         PermissionUsersManage,
+	"/v1.AdminAuth/forcePasswordReset": PermissionUsersManage,
+	"/v1.AdminAuth/deleteUser":         PermissionUsersManage,
+	"/v1.AdminAuth/unlockUser":         PermissionUsersManage,
+
+	"/v1.Todo/createTask":      PermissionTasksWrite,
+	"/v1.Todo/readTask":        PermissionTasksRead,
+	"/v1.Todo/updateTask":      PermissionTasksWrite,
+	"/v1.Todo/deleteTask":      PermissionTasksWrite,
+	"/v1.Todo/listTasksStream": PermissionTasksRead,
+	"/v1.Todo/listTasks":       PermissionTasksRead,
+	"/v1.Todo/deleteUserTasks": PermissionUsersManage,
+})
+
+// caseInsensitive lower-cases the method names: clients call the methods by
+// their proto names, while the generated server code reports the Go names.
+func caseInsensitive(permissions map[string]Permission) map[string]Permission {
+	lowered := make(map[string]Permission, len(permissions))
+
+	for method, permission := range permissions {
+		lowered[strings.ToLower(method)] = permission
+	}
+
+	return lowered
+}
+
+// IsValidRole reports whether the role is known to the policy.
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+
+	return ok
+}
+
+// IsPublicMethod reports whether the method can be called without a token.
+func IsPublicMethod(method string) bool {
+	permission, ok := methodPermissions[strings.ToLower(method)]
+
+	return ok && permission == PermissionPublic
+}
+
+// Authorize checks that one of the roles grants the permission the method
+// requires and, for tokens limited to scopes, that the scopes include it.
+func Authorize(method string, roles, scopes []string) error {
+	required, ok := methodPermissions[strings.ToLower(method)]
+	if !ok {
+		return status.Errorf(codes.PermissionDenied, "no policy for %s", method)
+	}
+
+	if required == PermissionPublic {
+		return nil
+	}
+
+	if !rolesGrant(roles, required) {
+		return status.Errorf(codes.PermissionDenied, "permission %s required", required)
+	}
+
+	if len(scopes) == 0 {
+		return nil
+	}
+
+	for _, scope := range scopes {
+		if Permission(scope) == required {
+			return nil
+		}
+	}
+
+	return status.Errorf(codes.PermissionDenied, "scope %s required", required)
+}
+
+// rolesGrant reports whether one of the roles grants the permission.
+func rolesGrant(roles []string, required Permission) bool {
+	for _, role := range roles {
+		for _, permission := range rolePermissions[role] {
+			if permission == required {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// SetUserRole assigns the role to the user. It takes effect with the next
+// token issued to them.
+func SetUserRole(ctx context.Context, db *sql.DB, login, role string) error {
+	if !IsValidRole(role) {
+		return fmt.Errorf("unknown role %q", role)
+	}
+
+	res, err := db.ExecContext(ctx, "UPDATE `user` SET `role` = ? WHERE login = ?", role, login)
+	if err != nil {
+		return fmt.Errorf("update role: %v", err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("update role: %v", err)
+	}
+
+	if affected == 0 {
+		return fmt.Errorf("user %q not found", login)
+	}
+
+	return nil
+}
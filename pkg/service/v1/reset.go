@@ -0,0 +1,116 @@
+package v1
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func createPasswordResetTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS password_reset_token (
+		id INTEGER PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		token_hash CHARACTER(64) UNIQUE NOT NULL,
+		expires_at INTEGER NOT NULL,
+		used_at INTEGER
+	);`)
+
+	return err
+}
+
+// issueResetToken stores a new reset token of the user. Only its hash is
+// kept, so the token is known to the recipient of the notification alone.
+func (s *authServiceServer) issueResetToken(ctx context.Context, userID int64, now time.Time) (string, time.Time, error) {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM `password_reset_token` WHERE expires_at < ?", now.Unix())
+	if err != nil {
+		return "", time.Time{}, storageError(err, "failed to prune `password_reset_token`")
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return "", time.Time{}, status.Error(codes.Internal, err.Error())
+	}
+
+	expiresAt := now.Add(s.config.PasswordResetTTL)
+
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO `password_reset_token`(ROWID, `user_id`, `token_hash`, `expires_at`) VALUES(null, ?, ?, ?)",
+		userID, hashToken(token), expiresAt.Unix(),
+	)
+	if err != nil {
+		return "", time.Time{}, storageError(err, "failed to insert into `password_reset_token`")
+	}
+
+	return token, expiresAt, nil
+}
+
+// consumeResetToken marks the reset token as used and returns its user. Any
+// other reset token of the user is used up along with it.
+func (s *authServiceServer) consumeResetToken(ctx context.Context, token string, now time.Time) (int64, error) {
+	row := s.db.QueryRowContext(ctx,
+		"SELECT id, user_id, expires_at, used_at FROM `password_reset_token` WHERE token_hash = ?",
+		hashToken(token))
+
+	var (
+		id, userID, expiresAt int64
+		usedAt                sql.NullInt64
+	)
+
+	err := row.Scan(&id, &userID, &expiresAt, &usedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, status.Error(codes.Unauthenticated, "invalid reset token")
+		}
+
+		return 0, storageError(err, "failed to select from `password_reset_token`")
+	}
+
+	if usedAt.Valid {
+		return 0, status.Error(codes.Unauthenticated, "reset token already used")
+	}
+
+	if now.Unix() >= expiresAt {
+		return 0, status.Error(codes.Unauthenticated, "reset token expired")
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE `password_reset_token` SET `used_at` = ? WHERE user_id = ? AND used_at IS NULL",
+		now.Unix(), userID)
+	if err != nil {
+		return 0, storageError(err, "failed to update `password_reset_token`")
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, storageError(err, "failed to update `password_reset_token`")
+	}
+
+	// Somebody else consumed a token of the user between our read and write.
+	if affected == 0 {
+		return 0, status.Error(codes.Unauthenticated, "reset token already used")
+	}
+
+	return userID, nil
+}
+
+// setPassword replaces the password of the user, lifts a forced reset and
+// signs the user out everywhere.
+func (s *authServiceServer) setPassword(ctx context.Context, userID int64, pass string) error {
+	passwordHash, err := hashPassword(pass, s.config.PasswordHash)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		"UPDATE `user` SET `password_hash` = ?, `password_reset_required` = 0 WHERE id = ?",
+		passwordHash, userID)
+	if err != nil {
+		return storageError(err, "failed to update `user`")
+	}
+
+	return revokeUserTokens(ctx, s.db, userID)
+}
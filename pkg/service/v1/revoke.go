@@ -0,0 +1,165 @@
+package v1
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+func createRevokedTokenTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS revoked_token (
+		jti VARCHAR(32) PRIMARY KEY,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS revoked_token_expires_at ON revoked_token (expires_at);
+	CREATE TABLE IF NOT EXISTS deleted_user (
+		id INTEGER PRIMARY KEY,
+		deleted_at INTEGER NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+
+	err = addColumn(ctx, db, "user", "tokens_revoked_at", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = addColumn(ctx, db, "user", "token_generation", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	// Tokens issued before the generation was recorded carry none, so users
+	// who revoked their tokens back then have to sign in once more.
+	_, err = db.ExecContext(ctx, "UPDATE `user` SET `token_generation` = 1 WHERE token_generation = 0 AND tokens_revoked_at > 0")
+
+	return err
+}
+
+// isRevoked reports whether the token was put on the deny-list, is of an
+// earlier generation than its owner, who revoked all of their sessions since
+// it was issued, its owner is disabled or deleted, its session was ended or
+// the API key it was issued for is no longer valid.
+func (s *authServiceServer) isRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	row := s.db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM `revoked_token` WHERE jti = ?), "+
+			"EXISTS(SELECT 1 FROM `deleted_user` WHERE id = ?), "+
+			"(SELECT token_generation FROM `user` WHERE id = ?), "+
+			"(SELECT disabled FROM `user` WHERE id = ?)",
+		claims.Id, claims.UserID, claims.UserID, claims.UserID)
+
+	var (
+		denied, deleted bool
+		generation      sql.NullInt64
+		disabled        sql.NullBool
+	)
+
+	err := row.Scan(&denied, &deleted, &generation, &disabled)
+	if err != nil {
+		return false, storageError(err, "failed to select from `revoked_token`")
+	}
+
+	// The user has been removed, so nothing issued to them is valid anymore.
+	if deleted || !generation.Valid {
+		return true, nil
+	}
+
+	if denied || disabled.Bool || claims.Generation < generation.Int64 {
+		return true, nil
+	}
+
+	if claims.ApiKeyID != 0 {
+		return s.isApiKeyRevoked(ctx, claims.UserID, claims.ApiKeyID, time.Now())
+	}
+
+	if claims.SessionID != 0 {
+		return s.isSessionRevoked(ctx, claims.UserID, claims.SessionID)
+	}
+
+	return false, nil
+}
+
+// revokeAccessToken puts the token on the deny-list until it expires and
+// prunes entries that are no longer needed.
+func (s *authServiceServer) revokeAccessToken(ctx context.Context, claims *Claims) error {
+	err := s.pruneRevoked(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		"INSERT OR IGNORE INTO `revoked_token`(`jti`, `expires_at`) VALUES(?, ?)",
+		claims.Id, claims.ExpiresAt)
+	if err != nil {
+		return storageError(err, "failed to insert into `revoked_token`")
+	}
+
+	return nil
+}
+
+// revokeUserTokens invalidates every access and refresh token issued to the user so far,
+// and the logins still waiting for their second factor.
+// Access tokens are told apart by their generation, not by their issue time, which is
+// in whole seconds and would also reject the tokens issued right after.
+func revokeUserTokens(ctx context.Context, db *sql.DB, userID int64) error {
+	now := time.Now().Unix()
+
+	_, err := db.ExecContext(ctx,
+		"UPDATE `user` SET `tokens_revoked_at` = ?, `token_generation` = `token_generation` + 1 WHERE id = ?",
+		now, userID)
+	if err != nil {
+		return storageError(err, "failed to update `user`")
+	}
+
+	_, err = db.ExecContext(ctx,
+		"UPDATE `refresh_token` SET `revoked_at` = ? WHERE user_id = ? AND revoked_at IS NULL",
+		now, userID)
+	if err != nil {
+		return storageError(err, "failed to update `refresh_token`")
+	}
+
+	_, err = db.ExecContext(ctx,
+		"UPDATE `session` SET `revoked_at` = ? WHERE user_id = ? AND revoked_at IS NULL",
+		now, userID)
+	if err != nil {
+		return storageError(err, "failed to update `session`")
+	}
+
+	_, err = db.ExecContext(ctx, "DELETE FROM `mfa_challenge` WHERE user_id = ?", userID)
+	if err != nil {
+		return storageError(err, "failed to delete from `mfa_challenge`")
+	}
+
+	return nil
+}
+
+// revokeRefreshToken revokes the family of the refresh token if it belongs to the user.
+func (s *authServiceServer) revokeRefreshToken(ctx context.Context, userID int64, refreshToken string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE `refresh_token` SET `revoked_at` = ? WHERE revoked_at IS NULL AND family = "+
+			"(SELECT family FROM `refresh_token` WHERE token_hash = ? AND user_id = ?)",
+		time.Now().Unix(), hashToken(refreshToken), userID)
+	if err != nil {
+		return storageError(err, "failed to update `refresh_token`")
+	}
+
+	return nil
+}
+
+// pruneRevoked drops deny-list entries and refresh tokens that have expired
+// and therefore would be rejected anyway.
+func (s *authServiceServer) pruneRevoked(ctx context.Context, now time.Time) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM `revoked_token` WHERE expires_at < ?", now.Unix())
+	if err != nil {
+		return storageError(err, "failed to prune `revoked_token`")
+	}
+
+	_, err = s.db.ExecContext(ctx, "DELETE FROM `refresh_token` WHERE expires_at < ?", now.Unix())
+	if err != nil {
+		return storageError(err, "failed to prune `refresh_token`")
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package v1
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/co-in/gbsfo-test/pkg/api/v1"
+)
+
+const (
+	// sessionTouchInterval limits how often the last-seen time of a session
+	// is written, as it is bumped on every token check.
+	sessionTouchInterval = time.Minute
+	userAgentMaxLength   = 255
+)
+
+func createSessionTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS session (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		user_agent VARCHAR(255) NOT NULL DEFAULT '',
+		ip VARCHAR(64) NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		last_seen_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		revoked_at INTEGER
+	);
+	CREATE INDEX IF NOT EXISTS session_user_id ON session (user_id);`)
+	if err != nil {
+		return err
+	}
+
+	err = useAutoincrement(ctx, db, "session")
+	if err != nil {
+		return err
+	}
+
+	return addColumn(ctx, db, "refresh_token", "session_id", "INTEGER")
+}
+
+// userAgent is the User-Agent of the HTTP client the gateway serves, or of
+// the gRPC client when it calls directly.
+func userAgent(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	for _, key := range []string{"grpcgateway-user-agent", "user-agent"} {
+		if values := md.Get(key); len(values) > 0 && values[0] != "" {
+			if len(values[0]) > userAgentMaxLength {
+				return values[0][:userAgentMaxLength]
+			}
+
+			return values[0]
+		}
+	}
+
+	return ""
+}
+
+// createSession records a sign-in of the user from the device making the call.
+func (s *authServiceServer) createSession(ctx context.Context, userID int64, now time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx,
+		"INSERT INTO `session`(ROWID, `user_id`, `user_agent`, `ip`, `created_at`, `last_seen_at`, `expires_at`) "+
+			"VALUES(null, ?, ?, ?, ?, ?, ?)",
+		userID, userAgent(ctx), s.clientIP(ctx), now.Unix(), now.Unix(), now.Add(s.config.RefreshTokenTTL).Unix(),
+	)
+	if err != nil {
+		return 0, storageError(err, "failed to insert into `session`")
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, storageError(err, "failed to retrieve id for created session")
+	}
+
+	return id, nil
+}
+
+// renewSession extends the session along with its refresh token.
+func (s *authServiceServer) renewSession(ctx context.Context, sessionID int64, now time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE `session` SET `last_seen_at` = ?, `expires_at` = ?, `ip` = ? WHERE id = ?",
+		now.Unix(), now.Add(s.config.RefreshTokenTTL).Unix(), s.clientIP(ctx), sessionID)
+	if err != nil {
+		return storageError(err, "failed to update `session`")
+	}
+
+	return nil
+}
+
+// touchSession bumps the last-seen time of the session. A failure only
+// means the time is a bit behind, so it is not reported to the caller.
+func (s *authServiceServer) touchSession(ctx context.Context, sessionID int64, now time.Time) {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE `session` SET `last_seen_at` = ? WHERE id = ? AND last_seen_at < ?",
+		now.Unix(), sessionID, now.Add(-sessionTouchInterval).Unix())
+	if err != nil {
+		log.Printf("touch session#%d: %v", sessionID, err)
+	}
+}
+
+// revokeSession ends the session of the user along with its refresh tokens.
+// Its access tokens are rejected from then on.
+func revokeSession(ctx context.Context, db *sql.DB, userID, sessionID int64) (bool, error) {
+	now := time.Now().Unix()
+
+	res, err := db.ExecContext(ctx,
+		"UPDATE `session` SET `revoked_at` = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		now, sessionID, userID)
+	if err != nil {
+		return false, storageError(err, "failed to update `session`")
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, storageError(err, "failed to update `session`")
+	}
+
+	if affected == 0 {
+		return false, nil
+	}
+
+	_, err = db.ExecContext(ctx,
+		"UPDATE `refresh_token` SET `revoked_at` = ? WHERE session_id = ? AND revoked_at IS NULL",
+		now, sessionID)
+	if err != nil {
+		return false, storageError(err, "failed to update `refresh_token`")
+	}
+
+	return true, nil
+}
+
+// isSessionRevoked reports whether the session of the user was ended or is gone.
+func (s *authServiceServer) isSessionRevoked(ctx context.Context, userID, sessionID int64) (bool, error) {
+	var active bool
+
+	err := s.db.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM `session` WHERE id = ? AND user_id = ? AND revoked_at IS NULL)", sessionID, userID,
+	).Scan(&active)
+	if err != nil {
+		return false, storageError(err, "failed to select from `session`")
+	}
+
+	return !active, nil
+}
+
+// ListSessions returns the sessions of the caller that are still active.
+func (s *authServiceServer) ListSessions(ctx context.Context, req *v1.ListSessionsRequest) (*v1.ListSessionsResponse, error) {
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	current := sessionIDFromContext(ctx)
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, user_agent, ip, created_at, last_seen_at FROM `session` "+
+			"WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ? ORDER BY last_seen_at DESC",
+		userID, time.Now().Unix())
+	if err != nil {
+		return nil, storageError(err, "failed to select from `session`")
+	}
+	defer rows.Close()
+
+	list := make([]*v1.Session, 0)
+
+	for rows.Next() {
+		var (
+			session               v1.Session
+			createdAt, lastSeenAt int64
+		)
+
+		err = rows.Scan(&session.Id, &session.UserAgent, &session.Ip, &createdAt, &lastSeenAt)
+		if err != nil {
+			return nil, storageError(err, "failed to retrieve field values from `session` row")
+		}
+
+		session.CreatedAt = timestamppb.New(time.Unix(createdAt, 0))
+		session.LastSeenAt = timestamppb.New(time.Unix(lastSeenAt, 0))
+		session.Current = session.Id == current
+
+		list = append(list, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, storageError(err, "failed to retrieve data from `session`")
+	}
+
+	return &v1.ListSessionsResponse{Sessions: list}, nil
+}
+
+// RevokeSession signs the caller out on one device, the other sessions are
+// left alone.
+func (s *authServiceServer) RevokeSession(ctx context.Context, req *v1.RevokeSessionRequest) (*v1.RevokeSessionResponse, error) {
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := revokeSession(ctx, s.db, userID, req.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !revoked {
+		return nil, status.Errorf(codes.NotFound, "session#%d not found", req.Id)
+	}
+
+	return &v1.RevokeSessionResponse{Success: true}, nil
+}
@@ -8,47 +8,127 @@ import (
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"log"
+	"strings"
 	"time"
 )
 
+// TodoConfig holds the settings of the todo service.
+type TodoConfig struct {
+	// LegacyTasksOwner is the user given the tasks created before tasks had
+	// owners. Until it is set, those tasks are left to nobody and are
+	// reported at startup.
+	LegacyTasksOwner int64
+}
+
 type todoServiceServer struct {
 	db *sql.DB
 }
 
-func NewTodoServiceServer(db *sql.DB) v1.TodoServer {
+func NewTodoServiceServer(db *sql.DB, config TodoConfig) v1.TodoServer {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
 	_, err := db.ExecContext(ctx, `
 	CREATE TABLE IF NOT EXISTS task (
 		id INTEGER PRIMARY KEY,
+		user_id INTEGER NOT NULL DEFAULT 0,
 		status INTEGER,
-		description TEXT
+		description TEXT,
+		version INTEGER NOT NULL DEFAULT 1,
+		create_time INTEGER,
+		update_time INTEGER,
+		complete_time INTEGER,
+		tags TEXT NOT NULL DEFAULT ''
 	);`)
 
 	if err != nil {
 		log.Print(err)
 	}
 
+	err = addColumn(ctx, db, "task", "user_id", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		log.Print(err)
+	}
+
+	err = assignLegacyTasks(ctx, db, config.LegacyTasksOwner)
+	if err != nil {
+		log.Print(err)
+	}
+
+	err = addColumn(ctx, db, "task", "version", "INTEGER NOT NULL DEFAULT 1")
+	if err != nil {
+		log.Print(err)
+	}
+
+	for _, column := range []string{"create_time", "update_time", "complete_time"} {
+		err = addColumn(ctx, db, "task", column, "INTEGER")
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	err = addColumn(ctx, db, "task", "tags", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		log.Print(err)
+	}
+
 	return &todoServiceServer{
 		db: db,
 	}
 }
 
+// assignLegacyTasks gives the tasks that have no owner, as they were created
+// before tasks had one, to the user. With no user, they are only counted.
+func assignLegacyTasks(ctx context.Context, db *sql.DB, owner int64) error {
+	if owner <= 0 {
+		var count int
+
+		err := db.QueryRowContext(ctx, "SELECT count(*) FROM `task` WHERE user_id = 0").Scan(&count)
+		if err != nil {
+			return fmt.Errorf("count legacy tasks: %v", err)
+		}
+
+		if count > 0 {
+			log.Printf("%d tasks have no owner and are not accessible, assign them with -legacy-tasks-owner", count)
+		}
+
+		return nil
+	}
+
+	res, err := db.ExecContext(ctx, "UPDATE `task` SET `user_id` = ? WHERE user_id = 0", owner)
+	if err != nil {
+		return fmt.Errorf("assign legacy tasks: %v", err)
+	}
+
+	assigned, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("assign legacy tasks: %v", err)
+	}
+
+	if assigned > 0 {
+		log.Printf("assigned %d tasks without owner to user#%d", assigned, owner)
+	}
+
+	return nil
+}
+
 func (s *todoServiceServer) connect(ctx context.Context) (*sql.Conn, error) {
 	c, err := s.db.Conn(ctx)
 	if err != nil {
-		return nil, status.Error(codes.Unknown, "failed to connect to database-> "+err.Error())
+		return nil, storageError(err, "failed to connect to database")
 	}
 
 	return c, nil
 }
 
-func (s *todoServiceServer) countTaskRecord(ctx context.Context) (int, error) {
-	rows, err := s.db.QueryContext(ctx, "SELECT count(*) AS total FROM `task`")
+func (s *todoServiceServer) countTaskRecord(ctx context.Context, userID int64, query *taskQuery) (int, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT count(*) AS total FROM `task` WHERE user_id = ?"+query.where,
+		append([]interface{}{userID}, query.args...)...)
 	if err != nil {
-		return 0, fmt.Errorf("failed to NamedQuery: %w", err)
+		return 0, storageError(err, "failed to count `task`")
 	}
 	defer rows.Close()
 
@@ -61,71 +141,159 @@ func (s *todoServiceServer) countTaskRecord(ctx context.Context) (int, error) {
 			return 0, nil
 		}
 
-		return 0, fmt.Errorf("failed to Scan: %w", err)
+		return 0, storageError(err, "failed to count `task`")
 	}
 
 	return count, nil
 }
 
-func (s *todoServiceServer) insert(ctx context.Context, task *v1.Task) (int64, error) {
-	res, err := s.db.ExecContext(ctx, "INSERT INTO `task` (ROWID, `status`, `description`) VALUES (null, ?, ?)",
-		task.Status, task.Description)
+func (s *todoServiceServer) insert(ctx context.Context, userID int64, task *v1.Task, tags []string) (int64, error) {
+	now := time.Now().Unix()
+
+	var completeTime sql.NullInt64
+	if task.Status {
+		completeTime = sql.NullInt64{Int64: now, Valid: true}
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		"INSERT INTO `task` (ROWID, `user_id`, `status`, `description`, `create_time`, `update_time`, `complete_time`, `tags`) "+
+			"VALUES (null, ?, ?, ?, ?, ?, ?, ?)",
+		userID, task.Status, task.Description, now, now, completeTime, joinTags(tags))
 	if err != nil {
-		return 0, fmt.Errorf("insert: %v", err)
+		return 0, storageError(err, "failed to insert into `task`")
 	}
 
 	id, err := res.LastInsertId()
 	if err != nil {
-		return 0, fmt.Errorf("getting id: %v", err)
+		return 0, storageError(err, "failed to retrieve id for created task")
 	}
 
 	return id, err
 }
 
-func (s *todoServiceServer) searchTaskRecord(ctx context.Context, limit, offset int) ([]*v1.Task, error) {
-	rows, err := s.db.QueryContext(ctx, "SELECT id, status, description FROM `task` LIMIT ? OFFSET ?", limit, offset)
+// taskColumns are the columns scanTask reads.
+const taskColumns = "id, status, description, version, create_time, update_time, complete_time, tags"
+
+func scanTask(row interface{ Scan(...interface{}) error }) (*v1.Task, error) {
+	var (
+		task                                 v1.Task
+		createTime, updateTime, completeTime sql.NullInt64
+		tags                                 string
+	)
+
+	err := row.Scan(&task.Id, &task.Status, &task.Description, &task.Version, &createTime, &updateTime, &completeTime,
+		&tags)
 	if err != nil {
-		return nil, fmt.Errorf("search task: %v", err)
+		return nil, err
+	}
+
+	task.CreateTime = timestampOrNil(createTime)
+	task.UpdateTime = timestampOrNil(updateTime)
+	task.CompleteTime = timestampOrNil(completeTime)
+	task.Tags = splitTags(tags)
+
+	return &task, nil
+}
+
+// joinTags stores the tags enclosed in commas, so a filter can match a whole
+// tag with LIKE '%,tag,%'.
+func joinTags(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	return "," + strings.Join(tags, ",") + ","
+}
+
+func splitTags(tags string) []string {
+	if tags == "" {
+		return nil
+	}
+
+	return strings.Split(strings.Trim(tags, ","), ",")
+}
+
+func timestampOrNil(t sql.NullInt64) *timestamppb.Timestamp {
+	if !t.Valid {
+		return nil
+	}
+
+	return timestamppb.New(time.Unix(t.Int64, 0))
+}
+
+func (s *todoServiceServer) searchTaskRecord(ctx context.Context, userID int64, query *taskQuery, limit, offset int) ([]*v1.Task, error) {
+	args := append(append([]interface{}{userID}, query.args...), limit, offset)
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+taskColumns+" FROM `task` WHERE user_id = ?"+query.where+" ORDER BY "+query.orderBy+" LIMIT ? OFFSET ?",
+		args...)
+	if err != nil {
+		return nil, storageError(err, "failed to select from `task`")
 	}
 	defer rows.Close()
 	tasks := make([]*v1.Task, 0)
 
 	for rows.Next() {
-		var task v1.Task
-
-		if err = rows.Scan(&task.Id, &task.Status, &task.Description); err != nil {
-			return nil, fmt.Errorf("search task scan: %v", err)
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, storageError(err, "failed to select from `task`")
 		}
 
-		tasks = append(tasks, &task)
+		tasks = append(tasks, task)
 	}
 
 	return tasks, nil
 }
 
-func (s *todoServiceServer) getTaskById(ctx context.Context, id int64) (*v1.Task, error) {
-	row := s.db.QueryRowContext(ctx, "SELECT id, status, description FROM `task` WHERE id = ?", id)
-	var task = new(v1.Task)
-	err := row.Scan(&task.Id, &task.Status, &task.Description)
+func (s *todoServiceServer) getTaskById(ctx context.Context, userID, id int64) (*v1.Task, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT "+taskColumns+" FROM `task` WHERE id = ? AND user_id = ?",
+		id, userID)
+	task, err := scanTask(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, status.Error(codes.NotFound, "task not found")
 		}
 
-		return nil, fmt.Errorf("scan task by id#%d: %v", id, err)
+		return nil, storageError(err, fmt.Sprintf("failed to select task#%d", id))
 	}
 
 	return task, nil
 
 }
 
+// taskExists reports whether the user has the task, to tell a missing task
+// from one at another version when a statement matched nothing.
+func (s *todoServiceServer) taskExists(ctx context.Context, userID, id int64) (bool, error) {
+	var exists bool
+
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM `task` WHERE id = ? AND user_id = ?)",
+		id, userID).Scan(&exists)
+	if err != nil {
+		return false, storageError(err, fmt.Sprintf("failed to select task#%d", id))
+	}
+
+	return exists, nil
+}
+
 func (s *todoServiceServer) CreateTask(ctx context.Context, request *v1.CreateTaskRequest) (*v1.CreateTaskResponse, error) {
-	id, err := s.insert(ctx, request.Task)
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var violations fieldViolations
+
+	tags := violations.checkTags("task.tags", request.Task.GetTags())
+	if err = violations.err(); err != nil {
+		return nil, err
+	}
+
+	id, err := s.insert(ctx, userID, request.Task, tags)
 	if err != nil {
-		return nil, fmt.Errorf("create task: %v", err)
+		return nil, err
 	}
 
-	task, err := s.getTaskById(ctx, id)
+	task, err := s.getTaskById(ctx, userID, id)
 
 	return &v1.CreateTaskResponse{
 		Task: task,
@@ -133,7 +301,12 @@ func (s *todoServiceServer) CreateTask(ctx context.Context, request *v1.CreateTa
 }
 
 func (s *todoServiceServer) ReadTask(ctx context.Context, request *v1.ReadTaskRequest) (*v1.ReadTaskResponse, error) {
-	task, err := s.getTaskById(ctx, request.Id)
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	task, err := s.getTaskById(ctx, userID, request.Id)
 	if err != nil {
 		return nil, err
 	}
@@ -142,24 +315,145 @@ func (s *todoServiceServer) ReadTask(ctx context.Context, request *v1.ReadTaskRe
 }
 
 func (s *todoServiceServer) UpdateTask(ctx context.Context, request *v1.UpdateTaskRequest) (*v1.UpdateTaskResponse, error) {
-	_, err := s.db.ExecContext(ctx, "UPDATE `task` SET `status` =?, `description` = ? WHERE id = ?",
-		request.Task.Status, request.Task.Description, request.Task.Id)
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 
+	if request.Task == nil {
+		return nil, status.Error(codes.InvalidArgument, "empty task")
+	}
+
+	now := time.Now().Unix()
+
+	columns, args, err := updateColumns(request.Task, request.UpdateMask, now)
 	if err != nil {
-		return nil, fmt.Errorf("update task: %v", err)
+		return nil, err
 	}
 
-	task, err := s.getTaskById(ctx, request.Task.Id)
+	versions, err := taskVersions(ctx, request.Task.Id, request.Task.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	condition, conditionArgs := versionCondition(versions)
+	columns = append(columns, "`version` = `version` + 1", "`update_time` = ?")
+	args = append(append(args, now, request.Task.Id, userID), conditionArgs...)
+
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE `task` SET "+strings.Join(columns, ", ")+" WHERE id = ? AND user_id = ?"+condition, args...)
+
+	if err != nil {
+		return nil, storageError(err, "failed to update `task`")
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, storageError(err, "failed to update `task`")
+	}
+
+	if affected == 0 {
+		return nil, s.unchangedTaskError(ctx, userID, request.Task.Id)
+	}
+
+	task, err := s.getTaskById(ctx, userID, request.Task.Id)
 
 	return &v1.UpdateTaskResponse{Task: task}, err
 }
 
+// unchangedTaskError tells why a statement on the task matched nothing: it is
+// gone or it is no longer at the version the caller expected.
+func (s *todoServiceServer) unchangedTaskError(ctx context.Context, userID, id int64) error {
+	exists, err := s.taskExists(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return versionMismatch(id)
+	}
+
+	return status.Error(codes.NotFound, "task not found")
+}
+
+// updateColumns returns the assignments for the fields of the task the mask
+// names, or for all of them when the mask is empty. Only the column names
+// known here ever make it into the query.
+func updateColumns(task *v1.Task, mask *fieldmaskpb.FieldMask, now int64) ([]string, []interface{}, error) {
+	paths := mask.GetPaths()
+	if len(paths) == 0 {
+		paths = []string{"status", "description", "tags"}
+	}
+
+	var (
+		columns    []string
+		args       []interface{}
+		violations fieldViolations
+	)
+
+	seen := make(map[string]bool, len(paths))
+
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+
+		seen[path] = true
+
+		switch path {
+		case "id", "version", "create_time", "update_time", "complete_time":
+			// Identify the task or are kept by the server, they are never set.
+		case "status":
+			// The completion time is kept while the task stays done, set
+			// when it becomes done and cleared when it is reopened. SET
+			// sees the status the task had before the update.
+			columns = append(columns, "`status` = ?",
+				"`complete_time` = CASE WHEN ? THEN CASE WHEN `status` THEN `complete_time` ELSE ? END END")
+			args = append(args, task.Status, task.Status, now)
+		case "description":
+			columns = append(columns, "`description` = ?")
+			args = append(args, task.Description)
+		case "tags":
+			columns = append(columns, "`tags` = ?")
+			args = append(args, joinTags(violations.checkTags("task.tags", task.Tags)))
+		default:
+			violations.add("update_mask", "unknown field %q", path)
+		}
+	}
+
+	return columns, args, violations.err()
+}
+
 func (s *todoServiceServer) DeleteTask(ctx context.Context, request *v1.DeleteTaskRequest) (*v1.DeleteTaskResponse, error) {
-	_, err := s.db.ExecContext(ctx, "DELETE  FROM `task` WHERE id = ?",
-		request.Id)
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return &v1.DeleteTaskResponse{Success: false}, err
+	}
 
+	versions, err := taskVersions(ctx, request.Id, request.Version)
 	if err != nil {
-		return &v1.DeleteTaskResponse{Success: false}, fmt.Errorf("delete task: %v", err)
+		return &v1.DeleteTaskResponse{Success: false}, err
+	}
+
+	condition, conditionArgs := versionCondition(versions)
+
+	res, err := s.db.ExecContext(ctx, "DELETE  FROM `task` WHERE id = ? AND user_id = ?"+condition,
+		append([]interface{}{request.Id, userID}, conditionArgs...)...)
+
+	if err != nil {
+		return &v1.DeleteTaskResponse{Success: false}, storageError(err, "failed to delete from `task`")
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return &v1.DeleteTaskResponse{Success: false}, storageError(err, "failed to delete from `task`")
+	}
+
+	if affected == 0 {
+		err = s.unchangedTaskError(ctx, userID, request.Id)
+		if status.Code(err) != codes.NotFound || !request.AllowMissing {
+			return &v1.DeleteTaskResponse{Success: false}, err
+		}
 	}
 
 	return &v1.DeleteTaskResponse{Success: true}, nil
@@ -167,10 +461,20 @@ func (s *todoServiceServer) DeleteTask(ctx context.Context, request *v1.DeleteTa
 
 func (s *todoServiceServer) ListTasksStream(request *v1.ListTaskStreamRequest, stream v1.Todo_ListTasksStreamServer) error {
 	ctx := stream.Context()
-	totalCount, err := s.countTaskRecord(ctx)
 
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	query, err := parseTaskQuery(request.Filter, request.OrderBy)
 	if err != nil {
-		return status.Errorf(codes.Internal, "failed to countUserRecord: %+v", err)
+		return err
+	}
+
+	totalCount, err := s.countTaskRecord(ctx, userID, query)
+	if err != nil {
+		return err
 	}
 
 	var concurrency = int(request.Concurrency)
@@ -200,9 +504,9 @@ func (s *todoServiceServer) ListTasksStream(request *v1.ListTaskStreamRequest, s
 			}
 
 			eg.Go(func() error {
-				records, err := s.searchTaskRecord(egCtx, limit, nextOffset)
+				records, err := s.searchTaskRecord(egCtx, userID, query, limit, nextOffset)
 				if err != nil {
-					return status.Errorf(codes.Internal, "failed to searchTaskRecord: %+v", err)
+					return err
 				}
 
 				taskResponse := &v1.ListTaskStreamResponse{
@@ -211,29 +515,33 @@ func (s *todoServiceServer) ListTasksStream(request *v1.ListTaskStreamRequest, s
 					Limit:  request.Limit,
 					Offset: uint32(nextOffset),
 				}
-				err = stream.Send(taskResponse)
-				if err != nil {
-					return status.Errorf(codes.Internal, "failed to searchUserRecord: %+v", err)
-				}
-
-				return nil
+				return stream.Send(taskResponse)
 			})
 		}
 		if err := eg.Wait(); err != nil {
-			return status.Errorf(codes.Internal, "failed to Wait: %+v", err)
+			return err
 		}
 
-		offset = offset + int(request.Limit)*int(request.Concurrency)
+		offset = offset + limit*concurrency
 	}
 
 	return nil
 }
 
 func (s *todoServiceServer) ListTasks(ctx context.Context, request *v1.ListTaskRequest) (*v1.ListTaskResponse, error) {
-	totalCount, err := s.countTaskRecord(ctx)
+	userID, err := userIDFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := parseTaskQuery(request.Filter, request.OrderBy)
+	if err != nil {
+		return nil, err
+	}
 
+	totalCount, err := s.countTaskRecord(ctx, userID, query)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to countUserRecord: %+v", err)
+		return nil, err
 	}
 
 	var offset = int(request.Offset)
@@ -242,9 +550,9 @@ func (s *todoServiceServer) ListTasks(ctx context.Context, request *v1.ListTaskR
 		limit = 100
 	}
 
-	records, err := s.searchTaskRecord(ctx, limit, offset)
+	records, err := s.searchTaskRecord(ctx, userID, query, limit, offset)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to searchTaskRecord: %+v", err)
+		return nil, err
 	}
 
 	taskResponse := &v1.ListTaskResponse{
@@ -256,3 +564,22 @@ func (s *todoServiceServer) ListTasks(ctx context.Context, request *v1.ListTaskR
 
 	return taskResponse, nil
 }
+
+// DeleteUserTasks removes every task of a user whose account is being deleted.
+func (s *todoServiceServer) DeleteUserTasks(ctx context.Context, request *v1.DeleteUserTasksRequest) (*v1.DeleteUserTasksResponse, error) {
+	if request.UserId <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid user id")
+	}
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM `task` WHERE user_id = ?", request.UserId)
+	if err != nil {
+		return nil, storageError(err, "failed to delete from `task`")
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return nil, storageError(err, "failed to delete from `task`")
+	}
+
+	return &v1.DeleteUserTasksResponse{Deleted: uint32(deleted)}, nil
+}
@@ -0,0 +1,243 @@
+package v1
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Claims are the JWT claims of an access token issued by the auth service.
+type Claims struct {
+	jwt.StandardClaims
+	UserID int64    `json:"id"`
+	Login  string   `json:"login"`
+	Roles  []string `json:"roles,omitempty"`
+	// Scope limits the token to these space separated permissions, it is
+	// set for tokens issued for an API key.
+	Scope     string `json:"scope,omitempty"`
+	ApiKeyID  int64  `json:"api_key_id,omitempty"`
+	SessionID int64  `json:"sid,omitempty"`
+	// Generation is the token generation of the user when the token was
+	// issued, revoking all tokens of the user moves it on.
+	Generation int64 `json:"gen,omitempty"`
+}
+
+type tokenPair struct {
+	accessToken  string
+	refreshToken string
+	expiresAt    time.Time
+}
+
+// randomToken returns n random bytes encoded as unpadded base64url.
+func randomToken(n int) (string, error) {
+	buff := make([]byte, n)
+
+	_, err := rand.Read(buff)
+	if err != nil {
+		return "", fmt.Errorf("generate random token: %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buff), nil
+}
+
+// hashToken is used for high-entropy opaque tokens, so a plain digest is enough.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(hash[:])
+}
+
+func createRefreshTokenTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS refresh_token (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		family CHARACTER(22) NOT NULL,
+		token_hash CHARACTER(64) UNIQUE NOT NULL,
+		expires_at INTEGER NOT NULL,
+		used_at INTEGER,
+		revoked_at INTEGER
+	);
+	CREATE INDEX IF NOT EXISTS refresh_token_family ON refresh_token (family);`)
+	if err != nil {
+		return err
+	}
+
+	err = useAutoincrement(ctx, db, "refresh_token")
+	if err != nil {
+		return err
+	}
+
+	return addColumn(ctx, db, "refresh_token", "issued_at", "INTEGER")
+}
+
+// signAccessToken fills in the registered claims and signs the token.
+func (s *authServiceServer) signAccessToken(claims *Claims, now, expiresAt time.Time) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	claims.StandardClaims = jwt.StandardClaims{
+		Id:        jti,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	}
+
+	tokenString, err := s.keyring.Active().Sign(claims)
+	if err != nil {
+		return "", fmt.Errorf("sign access token: %v", err)
+	}
+
+	return tokenString, nil
+}
+
+// issueTokens signs an access token and stores a new refresh token in the
+// given family and session. An empty family starts a new one, a zero
+// session records a new sign-in.
+func (s *authServiceServer) issueTokens(ctx context.Context, userID int64, family string, sessionID int64) (*tokenPair, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT login, role, token_generation FROM `user` WHERE id = ?", userID)
+
+	var (
+		login, role string
+		generation  int64
+	)
+
+	err := row.Scan(&login, &role, &generation)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Error(codes.Unauthenticated, "user not found")
+		}
+
+		return nil, storageError(err, "failed to select from `user`")
+	}
+
+	now := time.Now()
+
+	if sessionID == 0 {
+		sessionID, err = s.createSession(ctx, userID, now)
+	} else {
+		err = s.renewSession(ctx, sessionID, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := now.Add(s.config.AccessTokenTTL)
+
+	accessToken, err := s.signAccessToken(&Claims{
+		UserID:     userID,
+		Login:      login,
+		Roles:      []string{role},
+		SessionID:  sessionID,
+		Generation: generation,
+	}, now, expiresAt)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if family == "" {
+		family, err = randomToken(16)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		"INSERT INTO `refresh_token`(ROWID, `user_id`, `family`, `session_id`, `token_hash`, `issued_at`, `expires_at`) "+
+			"VALUES(null, ?, ?, ?, ?, ?, ?)",
+		userID, family, sessionID, hashToken(refreshToken), now.Unix(), now.Add(s.config.RefreshTokenTTL).Unix(),
+	)
+	if err != nil {
+		return nil, storageError(err, "failed to insert into `refresh_token`")
+	}
+
+	return &tokenPair{
+		accessToken:  accessToken,
+		refreshToken: refreshToken,
+		expiresAt:    expiresAt,
+	}, nil
+}
+
+// rotateRefreshToken consumes the refresh token and issues a new pair in the
+// same family. Presenting an already used token revokes the whole family.
+func (s *authServiceServer) rotateRefreshToken(ctx context.Context, refreshToken string) (*tokenPair, error) {
+	row := s.db.QueryRowContext(ctx,
+		"SELECT id, user_id, family, session_id, expires_at, used_at, revoked_at FROM `refresh_token` WHERE token_hash = ?",
+		hashToken(refreshToken))
+
+	var (
+		id, userID, expiresAt        int64
+		family                       string
+		sessionID, usedAt, revokedAt sql.NullInt64
+	)
+
+	err := row.Scan(&id, &userID, &family, &sessionID, &expiresAt, &usedAt, &revokedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, status.Error(codes.Unauthenticated, "invalid refresh token")
+		}
+
+		return nil, storageError(err, "failed to select from `refresh_token`")
+	}
+
+	if revokedAt.Valid {
+		return nil, status.Error(codes.Unauthenticated, "refresh token revoked")
+	}
+
+	now := time.Now()
+
+	if usedAt.Valid {
+		return nil, s.revokeRefreshFamily(ctx, family, now)
+	}
+
+	if now.Unix() >= expiresAt {
+		return nil, status.Error(codes.Unauthenticated, "refresh token expired")
+	}
+
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE `refresh_token` SET `used_at` = ? WHERE id = ? AND used_at IS NULL AND revoked_at IS NULL",
+		now.Unix(), id)
+	if err != nil {
+		return nil, storageError(err, "failed to update `refresh_token`")
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, storageError(err, "failed to update `refresh_token`")
+	}
+
+	// Somebody else consumed the token between our read and write.
+	if affected == 0 {
+		return nil, s.revokeRefreshFamily(ctx, family, now)
+	}
+
+	// Tokens issued before sessions were recorded start one now.
+	return s.issueTokens(ctx, userID, family, sessionID.Int64)
+}
+
+func (s *authServiceServer) revokeRefreshFamily(ctx context.Context, family string, now time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE `refresh_token` SET `revoked_at` = ? WHERE family = ? AND revoked_at IS NULL",
+		now.Unix(), family)
+	if err != nil {
+		return storageError(err, "failed to revoke refresh token family")
+	}
+
+	return status.Error(codes.Unauthenticated, "refresh token reuse detected")
+}
@@ -0,0 +1,161 @@
+package v1
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	loginMinLength = 3
+	loginMaxLength = 32
+	// passwordMaxLength bounds the work spent on hashing a password.
+	passwordMaxLength = 128
+	tagMaxLength      = 32
+	taskMaxTags       = 16
+)
+
+var (
+	loginPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+	tagPattern   = regexp.MustCompile(`^[\p{L}\p{N}_-]+$`)
+)
+
+// PasswordPolicy is what a new password has to satisfy.
+type PasswordPolicy struct {
+	// MinLength is the minimal number of characters.
+	MinLength int
+	// MinCharClasses is how many of lower case letters, upper case letters,
+	// digits and other characters have to be present.
+	MinCharClasses int
+	// Denylist holds passwords that are too common to be accepted,
+	// compared case-insensitively.
+	Denylist []string
+}
+
+// DefaultPasswordPolicy is used when AuthConfig has no policy set.
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:      8,
+	MinCharClasses: 2,
+	Denylist:       CommonPasswords,
+}
+
+// CommonPasswords are the most used passwords of public breach corpora.
+var CommonPasswords = []string{
+	"123456", "123456789", "12345678", "1234567890", "12345", "1234567", "111111", "000000",
+	"123123", "654321", "666666", "121212", "password", "password1", "password123", "passw0rd",
+	"qwerty", "qwerty123", "qwertyuiop", "1q2w3e4r", "1q2w3e4r5t", "1qaz2wsx", "zaq12wsx", "abc123",
+	"abcd1234", "iloveyou", "admin", "admin123", "welcome", "welcome1", "letmein", "monkey",
+	"dragon", "football", "baseball", "sunshine", "princess", "master", "superman", "trustno1",
+	"starwars", "shadow", "michael", "qazwsx", "asdfghjkl", "changeme", "secret", "p@ssw0rd",
+}
+
+// fieldViolations collects the problems found in a request.
+type fieldViolations []*errdetails.BadRequest_FieldViolation
+
+func (v *fieldViolations) add(field, format string, args ...interface{}) {
+	*v = append(*v, &errdetails.BadRequest_FieldViolation{
+		Field:       field,
+		Description: fmt.Sprintf(format, args...),
+	})
+}
+
+// err returns an InvalidArgument status detailing the violations, nil when
+// there are none.
+func (v fieldViolations) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+
+	st, err := status.New(codes.InvalidArgument, "invalid request").
+		WithDetails(&errdetails.BadRequest{FieldViolations: v})
+	if err != nil {
+		return status.Error(codes.InvalidArgument, v[0].Field+": "+v[0].Description)
+	}
+
+	return st.Err()
+}
+
+func (v *fieldViolations) checkLogin(field, login string) {
+	switch {
+	case len(login) < loginMinLength || len(login) > loginMaxLength:
+		v.add(field, "must be %d to %d characters long", loginMinLength, loginMaxLength)
+	case !loginPattern.MatchString(login):
+		v.add(field, "must start with a letter or digit and contain only letters, digits, '.', '_' and '-'")
+	}
+}
+
+// checkTags returns the tags of a task sorted and without duplicates, as
+// they are stored.
+func (v *fieldViolations) checkTags(field string, tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	unique := make([]string, 0, len(tags))
+
+	for _, tag := range tags {
+		switch {
+		case len([]rune(tag)) > tagMaxLength:
+			v.add(field, "tag %q must be at most %d characters long", tag, tagMaxLength)
+		case !tagPattern.MatchString(tag):
+			v.add(field, "tag %q must contain only letters, digits, '_' and '-'", tag)
+		case !seen[tag]:
+			seen[tag] = true
+			unique = append(unique, tag)
+		}
+	}
+
+	if len(unique) > taskMaxTags {
+		v.add(field, "must have at most %d tags", taskMaxTags)
+	}
+
+	sort.Strings(unique)
+
+	return unique
+}
+
+func (v *fieldViolations) checkPassword(field, pass string, policy PasswordPolicy) {
+	length := len([]rune(pass))
+
+	if length < policy.MinLength {
+		v.add(field, "must be at least %d characters long", policy.MinLength)
+	}
+
+	if length > passwordMaxLength {
+		v.add(field, "must be at most %d characters long", passwordMaxLength)
+	}
+
+	if classes := charClasses(pass); classes < policy.MinCharClasses {
+		v.add(field, "must contain at least %d of lower case letters, upper case letters, digits and symbols",
+			policy.MinCharClasses)
+	}
+
+	for _, common := range policy.Denylist {
+		if strings.EqualFold(pass, common) {
+			v.add(field, "is too common")
+			break
+		}
+	}
+}
+
+func charClasses(pass string) int {
+	var lower, upper, digit, other int
+
+	for _, r := range pass {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+
+	return lower + upper + digit + other
+}
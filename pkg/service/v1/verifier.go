@@ -0,0 +1,334 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/co-in/gbsfo-test/pkg/api/v1"
+)
+
+const (
+	// jwksRefetchBackoff limits how often an unknown kid triggers a JWKS fetch.
+	jwksRefetchBackoff = 5 * time.Second
+	// apiKeyRenewMargin is how long before it expires the token of an API key
+	// is exchanged for a new one, so it does not expire mid-call.
+	apiKeyRenewMargin = 10 * time.Second
+)
+
+// VerifierConfig holds the tunables of TokenVerifier.
+type VerifierConfig struct {
+	// CacheSize is the number of verified tokens kept in memory.
+	CacheSize int
+	// RevocationCheckInterval is how often a cached token is re-checked
+	// against the auth service for revocation.
+	RevocationCheckInterval time.Duration
+	// KeysRefreshInterval is how often the JWKS is re-fetched.
+	KeysRefreshInterval time.Duration
+}
+
+type verifiedToken struct {
+	claims    *v1.CheckJwtTokenResponse
+	expiresAt time.Time
+	checkedAt time.Time
+}
+
+// exchangedToken is the access token an API key was exchanged for.
+type exchangedToken struct {
+	token     string
+	apiKeyID  int64
+	expiresAt time.Time
+}
+
+// TokenVerifier verifies access tokens locally with the public keys of the
+// auth service and caches the result. The auth service is only asked
+// whether a token has been revoked once per RevocationCheckInterval,
+// counting from when the token was issued.
+type TokenVerifier struct {
+	auth   v1.AuthClient
+	config VerifierConfig
+	cache  *lruCache
+
+	mu            sync.Mutex
+	keys          KeySet
+	keysFetchedAt time.Time
+
+	// revocations holds when tokens, sessions and users were revoked. A
+	// token issued before may otherwise be accepted without asking the auth
+	// service for up to RevocationCheckInterval, so they are kept as long
+	// and apart from the cache, which could evict them.
+	revocationsMu sync.Mutex
+	revocations   map[string]time.Time
+}
+
+func NewTokenVerifier(auth v1.AuthClient, config VerifierConfig) *TokenVerifier {
+	return &TokenVerifier{
+		auth:        auth,
+		config:      config,
+		cache:       newLRUCache(config.CacheSize),
+		revocations: make(map[string]time.Time),
+	}
+}
+
+// Verify returns the claims of a valid access token.
+func (v *TokenVerifier) Verify(ctx context.Context, token string) (*v1.CheckJwtTokenResponse, error) {
+	key := hashToken(token)
+	now := time.Now()
+
+	if v.isRevoked(key, now) {
+		return nil, status.Error(codes.Unauthenticated, "token revoked")
+	}
+
+	if value, ok := v.cache.get(key); ok {
+		cached := value.(*verifiedToken)
+
+		if now.Before(cached.expiresAt) {
+			if now.Sub(cached.checkedAt) < v.config.RevocationCheckInterval {
+				return cached.claims, nil
+			}
+
+			return v.recheck(ctx, key, token, cached, now)
+		}
+
+		v.cache.remove(key)
+	}
+
+	claims, err := v.parse(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := checkJwtTokenResponse(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.SessionId != 0 && v.isRevoked(sessionKey(resp.SessionId), now) {
+		return nil, status.Error(codes.Unauthenticated, "token revoked")
+	}
+
+	cached := &verifiedToken{
+		claims:    resp,
+		expiresAt: time.Unix(claims.ExpiresAt, 0),
+		checkedAt: time.Unix(claims.IssuedAt, 0),
+	}
+
+	// Only the auth service can tell the tokens issued before the user
+	// revoked all of them from those issued after, in the same second.
+	if now.Sub(cached.checkedAt) >= v.config.RevocationCheckInterval || v.isRevoked(userKey(resp.UserId), now) {
+		return v.recheck(ctx, key, token, cached, now)
+	}
+
+	v.cache.add(key, cached)
+
+	return resp, nil
+}
+
+// VerifyApiKey exchanges the API key for an access token and returns it
+// along with its claims, so the call can be passed on with the token. The
+// token is cached and reused until shortly before it expires.
+func (v *TokenVerifier) VerifyApiKey(ctx context.Context, apiKey string) (string, *v1.CheckJwtTokenResponse, error) {
+	key := apiKeyCacheKey(apiKey)
+
+	if value, ok := v.cache.get(key); ok {
+		cached := value.(*exchangedToken)
+
+		if time.Now().Before(cached.expiresAt.Add(-apiKeyRenewMargin)) {
+			claims, err := v.Verify(ctx, cached.token)
+			if err == nil {
+				return cached.token, claims, nil
+			}
+
+			// The token may have been revoked along with the sessions of
+			// the user, while the key itself is still valid.
+			if status.Code(err) != codes.Unauthenticated {
+				return "", nil, err
+			}
+		}
+
+		v.cache.remove(key)
+	}
+
+	resp, err := v.auth.ExchangeApiKey(ctx, &v1.ExchangeApiKeyRequest{ApiKey: apiKey})
+	if err != nil {
+		return "", nil, err
+	}
+
+	claims, err := v.Verify(ctx, resp.Token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	v.cache.add(key, &exchangedToken{token: resp.Token, apiKeyID: claims.ApiKeyId, expiresAt: resp.ExpiresAt.AsTime()})
+
+	return resp.Token, claims, nil
+}
+
+func apiKeyCacheKey(apiKey string) string {
+	return "api-key#" + hashToken(apiKey)
+}
+
+// Revoke makes the verifier reject the token, e.g. after it was logged out.
+func (v *TokenVerifier) Revoke(token string) {
+	key := hashToken(token)
+
+	v.cache.remove(key)
+	v.addRevocation(key)
+}
+
+// RevokeUser makes the verifier reject every token of the user issued so far.
+func (v *TokenVerifier) RevokeUser(userID int64) {
+	v.cache.removeFunc(func(value interface{}) bool {
+		cached, ok := value.(*verifiedToken)
+
+		return ok && cached.claims.UserId == userID
+	})
+
+	v.addRevocation(userKey(userID))
+}
+
+// RevokeApiKey drops the tokens the API key was exchanged for, so it is
+// checked with the auth service again on its next use.
+func (v *TokenVerifier) RevokeApiKey(apiKeyID int64) {
+	v.cache.removeFunc(func(value interface{}) bool {
+		switch cached := value.(type) {
+		case *verifiedToken:
+			return cached.claims.ApiKeyId == apiKeyID
+		case *exchangedToken:
+			return cached.apiKeyID == apiKeyID
+		}
+
+		return false
+	})
+}
+
+// RevokeSession makes the verifier reject every token of the session.
+func (v *TokenVerifier) RevokeSession(sessionID int64) {
+	v.cache.removeFunc(func(value interface{}) bool {
+		cached, ok := value.(*verifiedToken)
+
+		return ok && cached.claims.SessionId == sessionID
+	})
+
+	v.addRevocation(sessionKey(sessionID))
+}
+
+func (v *TokenVerifier) addRevocation(key string) {
+	now := time.Now()
+
+	v.revocationsMu.Lock()
+	defer v.revocationsMu.Unlock()
+
+	for k, revokedAt := range v.revocations {
+		if now.Sub(revokedAt) >= v.config.RevocationCheckInterval {
+			delete(v.revocations, k)
+		}
+	}
+
+	v.revocations[key] = now
+}
+
+// isRevoked reports whether the token, session or user was revoked recently
+// enough that tokens issued before may not have been re-checked yet.
+func (v *TokenVerifier) isRevoked(key string, now time.Time) bool {
+	v.revocationsMu.Lock()
+	defer v.revocationsMu.Unlock()
+
+	revokedAt, ok := v.revocations[key]
+
+	return ok && now.Sub(revokedAt) < v.config.RevocationCheckInterval
+}
+
+func sessionKey(sessionID int64) string {
+	return fmt.Sprintf("session#%d", sessionID)
+}
+
+func userKey(userID int64) string {
+	return fmt.Sprintf("user#%d", userID)
+}
+
+// recheck asks the auth service whether the token was revoked. If the auth
+// service cannot be reached the cached claims are still served, so it is not
+// a hard dependency, and the check is retried on the next call.
+func (v *TokenVerifier) recheck(ctx context.Context, key, token string, cached *verifiedToken, now time.Time) (*v1.CheckJwtTokenResponse, error) {
+	resp, err := v.auth.CheckJWTToken(ctx, &v1.CheckJwtTokenRequest{Token: token})
+	if err != nil {
+		if code := status.Code(err); code == codes.Unavailable || code == codes.DeadlineExceeded {
+			log.Printf("revocation check skipped: %v", err)
+
+			return cached.claims, nil
+		}
+
+		v.cache.remove(key)
+
+		return nil, err
+	}
+
+	if !resp.Success {
+		v.cache.remove(key)
+
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	v.cache.add(key, &verifiedToken{
+		claims:    cached.claims,
+		expiresAt: cached.expiresAt,
+		checkedAt: now,
+	})
+
+	return cached.claims, nil
+}
+
+func (v *TokenVerifier) parse(ctx context.Context, token string) (*Claims, error) {
+	keys, err := v.keySet(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := keys.ParseToken(token)
+	if err == nil {
+		return claims, nil
+	}
+
+	// The token may be signed by a key rotated in after our last fetch.
+	refreshed, refreshErr := v.keySet(ctx, true)
+	if refreshErr == nil {
+		claims, err = refreshed.ParseToken(token)
+		if err == nil {
+			return claims, nil
+		}
+	}
+
+	return nil, status.Error(codes.Unauthenticated, "invalid token: "+err.Error())
+}
+
+func (v *TokenVerifier) keySet(ctx context.Context, force bool) (KeySet, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	age := time.Since(v.keysFetchedAt)
+	if v.keys != nil && age < v.config.KeysRefreshInterval && (!force || age < jwksRefetchBackoff) {
+		return v.keys, nil
+	}
+
+	resp, err := v.auth.GetJwks(ctx, &v1.GetJwksRequest{})
+	if err != nil {
+		if v.keys != nil {
+			log.Printf("JWKS refresh failed: %v", err)
+
+			return v.keys, nil
+		}
+
+		return nil, status.Error(codes.Unavailable, "failed to fetch JWKS: "+status.Convert(err).Message())
+	}
+
+	v.keys = NewKeySet(resp.Keys)
+	v.keysFetchedAt = time.Now()
+
+	return v.keys, nil
+}